@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	color "github.com/fatih/color"
+	ipfs "github.com/ipdr/ipdr/ipfs"
 	registry "github.com/ipdr/ipdr/registry"
 	regutil "github.com/ipdr/ipdr/regutil"
 	"github.com/ipdr/ipdr/server"
+	srvregistry "github.com/ipdr/ipdr/server/registry"
 	log "github.com/sirupsen/logrus"
 	cobra "github.com/spf13/cobra"
 )
@@ -21,8 +25,14 @@ var (
 	ErrImageIDRequired = errors.New("image hash or name is required")
 	// ErrOnlyOneArgumentRequired is error for when one argument only is required
 	ErrOnlyOneArgumentRequired = errors.New("only one argument is required")
+	// ErrTooManyArguments is error for when more arguments are given than accepted
+	ErrTooManyArguments = errors.New("too many arguments")
 	// ErrInvalidConvertFormat is error for when convert format is invalid
 	ErrInvalidConvertFormat = errors.New("convert format must be either \"docker\" or \"ipfs\"")
+	// ErrOutputRequired is error for when an output path is required
+	ErrOutputRequired = errors.New("output path is required")
+	// ErrInvalidContentFetcher is error for when the content fetcher is invalid
+	ErrInvalidContentFetcher = errors.New("content fetcher must be either \"gateway\", \"api\" or \"fallback\"")
 )
 
 func main() {
@@ -31,7 +41,8 @@ func main() {
 	}
 
 	var ipfsHost string
-	var ipfsGateway string
+	var ipfsGateways []string
+	var raceGateways bool
 	var format string
 	var dockerRegistryHost string
 	var port uint
@@ -40,7 +51,27 @@ func main() {
 	var silent bool
 	var cidResolvers []string
 	var cidStorePath string
+	var stagingPath string
+	var manifestCacheSize int64
+	var manifestCacheTTL time.Duration
+	var uploadTTL time.Duration
+	var blobCachePath string
+	var blobCacheSize int64
+	var contentFetcher string
+	var pushSource string
+	var compression string
+	var compressionLevel int
+	var exportFormat string
+	var exportPath string
+	var exportName string
 	var shortFormat bool
+	var pin bool
+	var pinService string
+	var pinToken string
+	var pinTimeout time.Duration
+	var ipnsKey string
+	var indexPath string
+	var indexKey string
 
 	rootCmd := &cobra.Command{
 		Use:   "ipdr",
@@ -55,28 +86,48 @@ More info: https://github.com/ipdr/ipdr`,
 	pushCmd := &cobra.Command{
 		Use:   "push",
 		Short: "Push image to IPFS-backed Docker registry",
-		Long:  "Push the Docker image to the InterPlanetary Docker Registry hosted on IPFS",
+		Long:  "Push the Docker image to the InterPlanetary Docker Registry hosted on IPFS. Several images are pushed under a single root, each under its repository path, e.g. /ipfs/<cid>/library/app",
 		Args: func(cmd *cobra.Command, args []string) error {
-			if len(args) == 0 {
+			if len(args) == 0 && pushSource == "" {
 				return ErrImageIDRequired
 			}
-			if len(args) != 1 {
+			if len(args) > 1 && pushSource != "" {
 				return ErrOnlyOneArgumentRequired
 			}
 
 			return nil
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if !(compression == registry.CompressionGzip || compression == registry.CompressionZstd || compression == registry.CompressionNone) {
+				return registry.ErrUnknownCompression
+			}
+
 			reg := registry.NewRegistry(&registry.Config{
 				DockerLocalRegistryHost: dockerRegistryHost,
 				IPFSHost:                ipfsHost,
-				IPFSGateway:             ipfsGateway,
+				Compression:             compression,
+				CompressionLevel:        compressionLevel,
+				NoPin:                   !pin,
+				PinService:              pinService,
+				PinToken:                pinTokenOrEnv(pinToken),
+				PinTimeout:              pinTimeout,
 				Debug:                   !silent,
 			})
 
-			imageID := args[0]
+			var imageID string
+			if len(args) > 0 {
+				imageID = args[0]
+			}
 
-			hash, err := reg.PushImageByID(imageID)
+			var hash string
+			var err error
+			if pushSource != "" {
+				hash, err = reg.PushFrom(pushSource, imageID)
+			} else if len(args) > 1 {
+				hash, err = reg.PushImagesByID(args)
+			} else {
+				hash, err = reg.PushImageByID(imageID)
+			}
 			if err != nil {
 				return err
 			}
@@ -93,6 +144,13 @@ More info: https://github.com/ipdr/ipdr`,
 	pushCmd.Flags().BoolVarP(&silent, "silent", "s", false, "Silent flag suppresses logs and outputs only IPFS hash")
 	pushCmd.Flags().StringVarP(&ipfsHost, "ipfs-host", "", "127.0.0.1:5001", "A remote IPFS API host to push the image to. Eg. 127.0.0.1:5001")
 	pushCmd.Flags().StringVarP(&dockerRegistryHost, "docker-registry-host", "", "docker.local:5000", "The Docker local registry host. Eg. 127.0.0.1:5000 Eg. docker.local:5000")
+	pushCmd.Flags().StringVar(&compression, "compression", registry.CompressionGzip, "Compression of uncompressed layers which can be \"gzip\", \"zstd\" or \"none\", layers that are already compressed are pushed as they are")
+	pushCmd.Flags().IntVar(&compressionLevel, "compression-level", 0, "Compression level of the gzip or zstd compression, 0 for the default level")
+	pushCmd.Flags().BoolVar(&pin, "pin", true, "Pin the pushed image on the IPFS node so that garbage collection keeps it")
+	pushCmd.Flags().StringVar(&pinService, "pin-service", "", "The endpoint of an IPFS Pinning Service API to also pin the image with. Eg. https://api.pinata.cloud/psa")
+	pushCmd.Flags().StringVar(&pinToken, "pin-token", "", "The access token of the pinning service, read from the IPDR_PIN_TOKEN environment variable if not set")
+	pushCmd.Flags().DurationVar(&pinTimeout, "pin-timeout", 10*time.Minute, "How long to wait for the pinning service to pin the image")
+	pushCmd.Flags().StringVarP(&pushSource, "from", "", "", "Push the image from an OCI layout directory, an archive or a remote registry instead of the Docker daemon, the image name:tag argument sets its tag. Eg. oci-layout:./out Eg. oci-archive:image.tar Eg. tarball:image.tar Eg. registry:localhost:5001/app:1.0")
 
 	pullCmd := &cobra.Command{
 		Use:   "pull",
@@ -112,7 +170,8 @@ More info: https://github.com/ipdr/ipdr`,
 			reg := registry.NewRegistry(&registry.Config{
 				DockerLocalRegistryHost: dockerRegistryHost,
 				IPFSHost:                ipfsHost,
-				IPFSGateway:             ipfsGateway,
+				IPFSGateway:             ipfsGateways[0],
+				IPFSGateways:            ipfsGateways[1:],
 				Debug:                   !silent,
 			})
 
@@ -133,7 +192,7 @@ More info: https://github.com/ipdr/ipdr`,
 
 	pullCmd.Flags().BoolVarP(&silent, "silent", "s", false, "Silent flag suppresses logs and outputs only Docker repo tag")
 	pullCmd.Flags().StringVarP(&ipfsHost, "ipfs-host", "", "127.0.0.1:5001", "A remote IPFS API host to pull the image from. Eg. 127.0.0.1:5001")
-	pullCmd.Flags().StringVarP(&ipfsGateway, "ipfs-gateway", "g", "127.0.0.1:8080", "The readonly IPFS Gateway URL to pull the image from. Eg. https://ipfs.io")
+	pullCmd.Flags().StringArrayVarP(&ipfsGateways, "ipfs-gateway", "g", []string{"127.0.0.1:8080"}, "The readonly IPFS Gateway URL to pull the image from, repeat to fail over to other gateways. Eg. https://ipfs.io")
 	pullCmd.Flags().StringVarP(&dockerRegistryHost, "docker-registry-host", "", "docker.local:5000", "The Docker local registry host. Eg. 127.0.0.1:5000 Eg. docker.local:5000")
 
 	serverCmd := &cobra.Command{
@@ -144,16 +203,35 @@ More info: https://github.com/ipdr/ipdr`,
 			if err := ensureCIDStorePath(cidStorePath); err != nil {
 				return err
 			}
+			if !(contentFetcher == "gateway" || contentFetcher == "api" || contentFetcher == "fallback") {
+				return ErrInvalidContentFetcher
+			}
 
 			srv := server.NewServer(&server.Config{
 				Port:         port,
 				Debug:        !silent,
 				IPFSHost:     ipfsHost,
-				IPFSGateway:  ipfsGateway,
+				IPFSGateway:  ipfsGateways[0],
+				IPFSGateways: ipfsGateways[1:],
+				RaceGateways: raceGateways,
 				CIDResolvers: cidResolvers,
 				CIDStorePath: cidStorePath,
+				StagingPath:  stagingPath,
 				TLSKeyPath:   tlsKeyPath,
 				TLSCertPath:  tlsCertPath,
+
+				UploadTTL:         uploadTTL,
+				ManifestCacheSize: manifestCacheSize,
+				ManifestCacheTTL:  manifestCacheTTL,
+				BlobCachePath:     blobCachePath,
+				BlobCacheSize:     blobCacheSize,
+				ContentFetcher:    contentFetcher,
+				NoPin:             !pin,
+				PinService:        pinService,
+				PinToken:          pinTokenOrEnv(pinToken),
+				PinTimeout:        pinTimeout,
+				IndexPath:         indexPath,
+				IndexKey:          indexKey,
 			})
 
 			return srv.Start()
@@ -161,8 +239,10 @@ More info: https://github.com/ipdr/ipdr`,
 	}
 
 	defaultCIDStore, _ := os.UserHomeDir()
+	defaultStaging := defaultCIDStore
 	if defaultCIDStore != "" {
 		defaultCIDStore = filepath.Join(defaultCIDStore, ".ipdr/cids")
+		defaultStaging = filepath.Join(defaultStaging, ".ipdr/staging")
 	}
 
 	serverCmd.Flags().BoolVarP(&silent, "silent", "s", false, "Silent flag suppresses logs")
@@ -170,9 +250,23 @@ More info: https://github.com/ipdr/ipdr`,
 	serverCmd.Flags().StringVarP(&tlsCertPath, "tlsCertPath", "", "", "The path to the .crt file for TLS")
 	serverCmd.Flags().StringVarP(&tlsKeyPath, "tlsKeyPath", "", "", "The path to the .key file for TLS")
 	serverCmd.Flags().StringVarP(&ipfsHost, "ipfs-host", "", "127.0.0.1:5001", "A remote IPFS API host to pull the image from. Eg. 127.0.0.1:5001")
-	serverCmd.Flags().StringVarP(&ipfsGateway, "ipfs-gateway", "g", "127.0.0.1:8080", "The readonly IPFS Gateway URL to pull the image from. Eg. https://ipfs.io")
+	serverCmd.Flags().StringArrayVarP(&ipfsGateways, "ipfs-gateway", "g", []string{"127.0.0.1:8080"}, "The readonly IPFS Gateway URL to pull the image from, repeat to fail over to other gateways. Eg. https://ipfs.io")
+	serverCmd.Flags().BoolVar(&raceGateways, "race-gateways", false, "Request content from all gateways at once and take the first response")
 	serverCmd.Flags().StringArrayVar(&cidResolvers, "cid-resolver", []string{"file:" + defaultCIDStore}, "Map repo:reference to CID. Accepts dnslink, IPFS path, and local file path.")
 	serverCmd.Flags().StringVar(&cidStorePath, "cid-store", defaultCIDStore, "CID local store location")
+	serverCmd.Flags().DurationVar(&uploadTTL, "upload-ttl", 24*time.Hour, "Remove blob uploads not written to within the duration, 0 to keep them")
+	serverCmd.Flags().Int64Var(&manifestCacheSize, "manifest-cache-size", 64<<20, "Maximum size in bytes of the manifest cache kept in the CID store, 0 for unbounded")
+	serverCmd.Flags().DurationVar(&manifestCacheTTL, "manifest-cache-ttl", 24*time.Hour, "Evict cached manifests and tags not used within the duration, 0 to keep them")
+	serverCmd.Flags().StringVar(&contentFetcher, "content-fetcher", "gateway", "How content is read from IPFS: gateway, api (cat over the IPFS API host), or fallback (gateway, then API)")
+	serverCmd.Flags().StringVar(&blobCachePath, "blob-cache-dir", "", "Directory to cache blobs pulled from IPFS in, disabled if empty")
+	serverCmd.Flags().Int64Var(&blobCacheSize, "blob-cache-size", 10<<30, "Maximum size in bytes of the blob cache, 0 for unbounded")
+	serverCmd.Flags().BoolVar(&pin, "pin", true, "Pin pushed images on the IPFS node so that garbage collection keeps them")
+	serverCmd.Flags().StringVar(&pinService, "pin-service", "", "The endpoint of an IPFS Pinning Service API to also pin pushed images with. Eg. https://api.pinata.cloud/psa")
+	serverCmd.Flags().StringVar(&pinToken, "pin-token", "", "The access token of the pinning service, read from the IPDR_PIN_TOKEN environment variable if not set")
+	serverCmd.Flags().DurationVar(&pinTimeout, "pin-timeout", 10*time.Minute, "How long to wait for the pinning service to pin pushed images")
+	serverCmd.Flags().StringVar(&indexPath, "index", "", "Update the registry index, an MFS directory of repo/tag -> cid files of the IPFS node, on every push and return its root CID in the X-Registry-Index header, disabled if empty. Eg. /ipdr/index")
+	serverCmd.Flags().StringVar(&indexKey, "index-key", "", "Republish the registry index under the IPNS key of the IPFS node after every push. Eg. self")
+	serverCmd.Flags().StringVar(&stagingPath, "staging-dir", defaultStaging, "Directory where pushed blobs are staged until they are added to IPFS")
 
 	convertCmd := &cobra.Command{
 		Use:   "convert",
@@ -232,9 +326,200 @@ More info: https://github.com/ipdr/ipdr`,
 	digCmd.Flags().StringVarP(&dockerRegistryHost, "docker-registry-host", "", "docker.local:5000", "The Docker local registry host. Eg. 127.0.0.1:5000 Eg. docker.local:5000")
 	digCmd.Flags().BoolVar(&shortFormat, "short", true, "CID or manifest content")
 
+	exportCmd := &cobra.Command{
+		Use:   "export <cid>[:tag]",
+		Short: "Export image from IPFS to a Docker tarball or an OCI image layout",
+		Long:  "Export the Docker image stored on IPFS to a tarball that can be loaded with `docker load` or to an OCI image layout directory, without running the registry server",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return ErrImageIDRequired
+			}
+			if len(args) != 1 {
+				return ErrOnlyOneArgumentRequired
+			}
+			if exportPath == "" {
+				return ErrOutputRequired
+			}
+			if !(exportFormat == registry.ExportDocker || exportFormat == registry.ExportOCI) {
+				return registry.ErrUnknownExportFormat
+			}
+
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			reg := registry.NewRegistry(&registry.Config{
+				DockerLocalRegistryHost: dockerRegistryHost,
+				IPFSHost:                ipfsHost,
+				Debug:                   !silent,
+			})
+
+			ss := strings.SplitN(args[0], ":", 2)
+			ipfsHash, tag := ss[0], "latest"
+			if len(ss) == 2 {
+				tag = ss[1]
+			}
+
+			if err := reg.ExportImage(ipfsHash, tag, exportFormat, exportPath, exportName); err != nil {
+				return err
+			}
+
+			if silent {
+				fmt.Println(exportPath)
+			} else {
+				fmt.Println(green.Sprintf("\nSuccessfully exported Docker image from IPFS:\n%s", exportPath))
+			}
+			return nil
+		},
+	}
+
+	exportCmd.Flags().BoolVarP(&silent, "silent", "s", false, "Silent flag suppresses logs and outputs only the export path")
+	exportCmd.Flags().StringVarP(&ipfsHost, "ipfs-host", "", "127.0.0.1:5001", "A remote IPFS API host to read the image from. Eg. 127.0.0.1:5001")
+	exportCmd.Flags().StringVarP(&exportFormat, "format", "f", registry.ExportDocker, "Export format which can be \"docker\" for a docker load tarball or \"oci\" for an OCI image layout directory")
+	exportCmd.Flags().StringVarP(&exportPath, "output", "o", "", "The file or, for the \"oci\" format, directory to write the image to")
+	exportCmd.Flags().StringVarP(&exportName, "name", "", "", "The name:tag of the image in a Docker tarball. Eg. example/helloworld:latest")
+	exportCmd.Flags().StringVarP(&dockerRegistryHost, "docker-registry-host", "", "docker.local:5000", "The Docker local registry host. Eg. 127.0.0.1:5000 Eg. docker.local:5000")
+
+	newPinner := func() *srvregistry.Pinner {
+		return srvregistry.NewPinner(ipfs.NewRemoteClient(&ipfs.Config{Host: ipfsHost}), cidStorePath)
+	}
+
+	pinCmd := &cobra.Command{
+		Use:   "pin",
+		Short: "Manage the pins of images on IPFS",
+		Long:  "List, add and remove the pins that keep images from being garbage collected on the IPFS node. Tags are mapped to CIDs with the CID store of the registry server.",
+	}
+
+	pinLsCmd := &cobra.Command{
+		Use:   "ls",
+		Short: "List pinned CIDs and the tags they are pinned for",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			pins, err := newPinner().List()
+			if err != nil {
+				return err
+			}
+			for _, p := range pins {
+				fmt.Println(strings.TrimSpace(p.CID + " " + strings.Join(p.Tags, " ")))
+			}
+			return nil
+		},
+	}
+
+	pinAddCmd := &cobra.Command{
+		Use:   "add <repo[:tag]|cid>",
+		Short: "Pin an image by tag or CID",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return ErrImageIDRequired
+			}
+			if len(args) != 1 {
+				return ErrOnlyOneArgumentRequired
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cid, err := newPinner().Pin(args[0])
+			if err != nil {
+				return err
+			}
+			if silent {
+				fmt.Println(cid)
+			} else {
+				fmt.Println(green.Sprintf("Pinned %s:\n/ipfs/%s", args[0], cid))
+			}
+			return nil
+		},
+	}
+
+	pinRmCmd := &cobra.Command{
+		Use:   "rm <repo[:tag]|cid>",
+		Short: "Unpin an image by tag or CID",
+		Long:  "Unpin an image by tag or CID. The CID of a tag stays pinned while other tags are pinned for it.",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return ErrImageIDRequired
+			}
+			if len(args) != 1 {
+				return ErrOnlyOneArgumentRequired
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cid, unpinned, err := newPinner().Unpin(args[0])
+			if err != nil {
+				return err
+			}
+			if silent {
+				fmt.Println(cid)
+			} else if unpinned {
+				fmt.Println(green.Sprintf("Unpinned %s:\n/ipfs/%s", args[0], cid))
+			} else {
+				fmt.Println(green.Sprintf("Removed %s, /ipfs/%s stays pinned for other tags", args[0], cid))
+			}
+			return nil
+		},
+	}
+
+	for _, c := range []*cobra.Command{pinLsCmd, pinAddCmd, pinRmCmd} {
+		c.Flags().StringVarP(&ipfsHost, "ipfs-host", "", "127.0.0.1:5001", "The IPFS API host to manage the pins of. Eg. 127.0.0.1:5001")
+		c.Flags().StringVar(&cidStorePath, "cid-store", defaultCIDStore, "CID local store location")
+	}
+	pinAddCmd.Flags().BoolVarP(&silent, "silent", "s", false, "Silent flag outputs only the CID")
+	pinRmCmd.Flags().BoolVarP(&silent, "silent", "s", false, "Silent flag outputs only the CID")
+	pinCmd.AddCommand(pinLsCmd, pinAddCmd, pinRmCmd)
+
+	tagCmd := &cobra.Command{
+		Use:   "tag",
+		Short: "Manage tags published on IPNS",
+		Long:  "Publish image tags in an IPFS directory under an IPNS name, which registry servers resolve with --cid-resolver /ipns/<name>",
+	}
+
+	tagPublishCmd := &cobra.Command{
+		Use:   "publish <repo[:tag]> [cid]",
+		Short: "Publish a tag under an IPNS key",
+		Long:  "Add repo/tag -> cid to the IPFS directory published under the IPNS key and republish it. The CID is looked up in the CID store of the registry server if it is not given.",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return ErrImageIDRequired
+			}
+			if len(args) > 2 {
+				return ErrTooManyArguments
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var cid string
+			if len(args) > 1 {
+				cid = args[1]
+			}
+
+			client := ipfs.NewRemoteClient(&ipfs.Config{Host: ipfsHost})
+			published, err := srvregistry.NewTagPublisher(client, cidStorePath, ipnsKey).Publish(args[0], cid)
+			if err != nil {
+				return err
+			}
+
+			if silent {
+				fmt.Println(published.Name)
+			} else {
+				fmt.Println(green.Sprintf("\nSuccessfully published %s:%s -> %s under:\n/ipns/%s", published.Repo, published.Reference, published.CID, published.Name))
+			}
+			return nil
+		},
+	}
+
+	tagPublishCmd.Flags().BoolVarP(&silent, "silent", "s", false, "Silent flag outputs only the IPNS name")
+	tagPublishCmd.Flags().StringVar(&ipnsKey, "key", "self", "The key of the IPFS node to publish the tags under")
+	tagPublishCmd.Flags().StringVarP(&ipfsHost, "ipfs-host", "", "127.0.0.1:5001", "The IPFS API host to publish with. Eg. 127.0.0.1:5001")
+	tagPublishCmd.Flags().StringVar(&cidStorePath, "cid-store", defaultCIDStore, "CID local store location")
+	tagCmd.AddCommand(tagPublishCmd)
+
 	rootCmd.AddCommand(
 		pushCmd,
 		pullCmd,
+		exportCmd,
+		pinCmd,
+		tagCmd,
 		serverCmd,
 		convertCmd,
 		digCmd,
@@ -245,6 +530,14 @@ More info: https://github.com/ipdr/ipdr`,
 	}
 }
 
+// pinTokenOrEnv returns the pinning service token, or the one of the environment if it is empty
+func pinTokenOrEnv(token string) string {
+	if token == "" {
+		return os.Getenv("IPDR_PIN_TOKEN")
+	}
+	return token
+}
+
 func ensureCIDStorePath(location string) error {
 	return os.MkdirAll(location, os.ModePerm)
 }
@@ -3,6 +3,7 @@ module github.com/ipdr/ipdr
 go 1.12
 
 require (
+	github.com/docker/distribution v2.7.1+incompatible
 	github.com/docker/docker v1.4.2-0.20190924003213-a8608b5b67c7
 	github.com/fatih/color v1.7.0
 	github.com/google/go-containerregistry v0.3.0
@@ -10,6 +11,7 @@ require (
 	github.com/ipfs/go-ipfs-api v0.0.1
 	github.com/ipfs/go-ipfs-files v0.0.1
 	github.com/jbenet/go-base58 v0.0.0-20150317085156-6237cf65f3a6
+	github.com/klauspost/compress v1.11.4
 	github.com/mattn/go-colorable v0.1.1 // indirect
 	github.com/mattn/go-isatty v0.0.6 // indirect
 	github.com/multiformats/go-multibase v0.0.3
@@ -0,0 +1,265 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipdr/ipdr/netutil"
+)
+
+// ErrNoGateways is returned when a gateway pool has no gateways to send a request to
+var ErrNoGateways = errors.New("no IPFS gateways configured")
+
+const (
+	defaultGatewayTimeout = 30 * time.Second
+	maxGatewayBackoff     = 5 * time.Minute
+)
+
+// GatewayPoolConfig is the config for the gateway pool
+type GatewayPoolConfig struct {
+	URLs []string
+	// Race sends requests to all gateways at once and takes the first successful response
+	Race bool
+	// Timeout bounds the time to wait for response headers from a gateway
+	Timeout time.Duration
+}
+
+// GatewayPool sends requests to a list of IPFS gateways, failing over to the next
+// gateway on errors. Failing gateways are tried last until they have backed off.
+type GatewayPool struct {
+	gateways []*gateway
+	race     bool
+	timeout  time.Duration
+	lock     sync.Mutex
+}
+
+type gateway struct {
+	url      string
+	failures uint
+	retryAt  time.Time
+}
+
+// NewGatewayPool returns a new gateway pool
+func NewGatewayPool(config *GatewayPoolConfig) *GatewayPool {
+	if config == nil {
+		config = &GatewayPoolConfig{}
+	}
+
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = defaultGatewayTimeout
+	}
+
+	p := &GatewayPool{
+		race:    config.Race,
+		timeout: timeout,
+	}
+	seen := map[string]bool{}
+	for _, u := range config.URLs {
+		if u == "" || seen[u] {
+			continue
+		}
+		seen[u] = true
+		p.gateways = append(p.gateways, &gateway{url: u})
+	}
+	return p
+}
+
+// URLs returns the gateway URLs, healthy gateways first
+func (p *GatewayPool) URLs() []string {
+	var urls []string
+	for _, g := range p.order() {
+		urls = append(urls, g.url)
+	}
+	return urls
+}
+
+// Do sends the request built by newReq for a gateway URL to the gateways of the pool.
+// Requests fail over to the next gateway on errors, timeouts and server errors,
+// or are raced against each other if the pool is configured to do so.
+// If no gateway succeeds, a not found response is preferred over other failed responses and errors.
+func (p *GatewayPool) Do(newReq func(gateway string) (*http.Request, error)) (*http.Response, error) {
+	gateways := p.order()
+	if len(gateways) == 0 {
+		return nil, ErrNoGateways
+	}
+	if p.race && len(gateways) > 1 {
+		return p.doRace(gateways, newReq)
+	}
+
+	var failed *http.Response
+	var err error
+	for _, g := range gateways {
+		var resp *http.Response
+		resp, err = p.send(context.Background(), g, newReq)
+		if p.record(g, resp, err) {
+			closeResponse(failed)
+			return resp, nil
+		}
+		failed = pickFailure(failed, resp)
+	}
+	if failed != nil {
+		return failed, nil
+	}
+	return nil, err
+}
+
+func (p *GatewayPool) doRace(gateways []*gateway, newReq func(gateway string) (*http.Request, error)) (*http.Response, error) {
+	type result struct {
+		i    int
+		resp *http.Response
+		err  error
+	}
+
+	results := make(chan result, len(gateways))
+	cancels := make([]context.CancelFunc, len(gateways))
+	for i, g := range gateways {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels[i] = cancel
+		go func(i int, g *gateway) {
+			resp, err := p.send(ctx, g, newReq)
+			results <- result{i, resp, err}
+		}(i, g)
+	}
+
+	var failed *http.Response
+	var err error
+	for n := 1; n <= len(gateways); n++ {
+		r := <-results
+		if !p.record(gateways[r.i], r.resp, r.err) {
+			failed = pickFailure(failed, r.resp)
+			err = r.err
+			continue
+		}
+
+		// abort the other requests and release their responses
+		for i, cancel := range cancels {
+			if i != r.i {
+				cancel()
+			}
+		}
+		closeResponse(failed)
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				if r := <-results; r.resp != nil {
+					r.resp.Body.Close()
+				}
+			}
+		}(len(gateways) - n)
+		return r.resp, nil
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+	if failed != nil {
+		return failed, nil
+	}
+	return nil, err
+}
+
+// send sends the request to a gateway, giving up if no response arrives within the timeout.
+func (p *GatewayPool) send(ctx context.Context, g *gateway, newReq func(gateway string) (*http.Request, error)) (*http.Response, error) {
+	req, err := newReq(g.url)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(p.timeout, cancel)
+	resp, err := netutil.Stream(req.WithContext(ctx))
+	if err != nil || !timer.Stop() {
+		cancel()
+		if err == nil {
+			resp.Body.Close()
+			err = context.DeadlineExceeded
+		}
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// record updates the health of a gateway and reports whether the response is usable.
+func (p *GatewayPool) record(g *gateway, resp *http.Response, err error) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		g.failures++
+		backoff := time.Second << minUint(g.failures, 9)
+		if backoff > maxGatewayBackoff {
+			backoff = maxGatewayBackoff
+		}
+		g.retryAt = time.Now().Add(backoff)
+		return false
+	}
+
+	g.failures = 0
+	g.retryAt = time.Time{}
+
+	// content may still be found on another gateway
+	return resp.StatusCode != http.StatusNotFound
+}
+
+// order returns the gateways that are not backing off in the configured order,
+// followed by the ones that are, soonest to retry first.
+func (p *GatewayPool) order() []*gateway {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	var healthy, failing []*gateway
+	for _, g := range p.gateways {
+		if g.retryAt.After(now) {
+			failing = append(failing, g)
+		} else {
+			healthy = append(healthy, g)
+		}
+	}
+	sort.SliceStable(failing, func(i, j int) bool {
+		return failing[i].retryAt.Before(failing[j].retryAt)
+	})
+	return append(healthy, failing...)
+}
+
+// pickFailure returns the more meaningful of two failed responses and closes the other.
+// A gateway not finding the content is preferred over gateway errors.
+func pickFailure(a, b *http.Response) *http.Response {
+	if a == nil {
+		return b
+	}
+	if b == nil || a.StatusCode == http.StatusNotFound {
+		closeResponse(b)
+		return a
+	}
+	closeResponse(a)
+	return b
+}
+
+func closeResponse(resp *http.Response) {
+	if resp != nil {
+		resp.Body.Close()
+	}
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func minUint(a, b uint) uint {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,79 @@
+package ipfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGatewayPool(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "slow")
+	}))
+	defer slow.Close()
+	missing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer missing.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "up")
+	}))
+	defer up.Close()
+
+	get := func(gateway string) (*http.Request, error) {
+		return http.NewRequest("GET", gateway+"/ipfs/cid", nil)
+	}
+
+	for i, tt := range []struct {
+		urls    []string
+		race    bool
+		timeout time.Duration
+		want    string
+		status  int
+		first   string
+	}{
+		{[]string{down.URL, up.URL}, false, 0, "up", http.StatusOK, up.URL},
+		{[]string{"http://127.0.0.1:1", up.URL}, false, 0, "up", http.StatusOK, up.URL},
+		{[]string{missing.URL, up.URL}, false, 0, "up", http.StatusOK, missing.URL},
+		{[]string{slow.URL, up.URL}, false, 50 * time.Millisecond, "up", http.StatusOK, up.URL},
+		{[]string{slow.URL, up.URL}, true, 0, "up", http.StatusOK, slow.URL},
+		{[]string{down.URL, missing.URL}, true, 0, "", http.StatusNotFound, missing.URL},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			p := NewGatewayPool(&GatewayPoolConfig{
+				URLs:    tt.urls,
+				Race:    tt.race,
+				Timeout: tt.timeout,
+			})
+			resp, err := p.Do(get)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("want %v, got %v", tt.status, resp.StatusCode)
+			}
+			if string(b) != tt.want {
+				t.Errorf("want %v, got %s", tt.want, b)
+			}
+			// failing gateways are tried last
+			if first := p.URLs()[0]; first != tt.first {
+				t.Errorf("want %v, got %v", tt.first, first)
+			}
+		})
+	}
+
+	p := NewGatewayPool(nil)
+	if _, err := p.Do(get); err != ErrNoGateways {
+		t.Errorf("want %v, got %v", ErrNoGateways, err)
+	}
+}
@@ -0,0 +1,276 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// ImageBuilder collects the manifests and blobs of an image so that they can be
+// added to IPFS in a single streaming request, laid out as:
+//
+//	manifests/<tag or digest>
+//	blobs/<digest>
+//
+// Blobs that are already on IPFS can be linked by CID instead of being added again.
+// Several images can be laid out side by side under their repository paths, e.g.
+//
+//	library/app/manifests/<tag>
+//	library/app/blobs/<digest>
+//	org/tool/manifests/<tag>
+//
+// in which case blobs shared between repositories are only streamed once.
+type ImageBuilder struct {
+	manifests map[string]files.Node
+	blobs     map[string]files.Node
+	links     map[string]string
+	repos     map[string]*ImageBuilder
+	closers   []io.Closer
+}
+
+// NewImageBuilder returns a new image builder
+func NewImageBuilder() *ImageBuilder {
+	return &ImageBuilder{
+		manifests: map[string]files.Node{},
+		blobs:     map[string]files.Node{},
+		links:     map[string]string{},
+		repos:     map[string]*ImageBuilder{},
+	}
+}
+
+// Repository returns the builder of the image laid out under the repository path, e.g. library/app
+func (b *ImageBuilder) Repository(path string) *ImageBuilder {
+	path = strings.Trim(path, "/")
+	if repo, ok := b.repos[path]; ok {
+		return repo
+	}
+	repo := NewImageBuilder()
+	b.repos[path] = repo
+	return repo
+}
+
+// AddManifest adds manifest content under a tag or digest
+func (b *ImageBuilder) AddManifest(reference string, data []byte) {
+	b.manifests[reference] = files.NewBytesFile(data)
+}
+
+// AddManifestFile adds the manifest stored at path under a tag or digest
+func (b *ImageBuilder) AddManifestFile(reference, path string) error {
+	f, err := b.open(path)
+	if err != nil {
+		return err
+	}
+	b.manifests[reference] = f
+	return nil
+}
+
+// AddBlob adds a blob that is streamed from r. If r is an io.Closer it is closed
+// once the image has been built.
+func (b *ImageBuilder) AddBlob(digest string, r io.Reader) {
+	if c, ok := r.(io.Closer); ok {
+		b.closers = append(b.closers, c)
+	}
+	b.blobs[digest] = files.NewReaderFile(r)
+}
+
+// AddBlobFile adds the blob stored at path
+func (b *ImageBuilder) AddBlobFile(digest, path string) error {
+	f, err := b.open(path)
+	if err != nil {
+		return err
+	}
+	b.blobs[digest] = f
+	return nil
+}
+
+// LinkBlob links a blob that is already stored on IPFS under cid
+func (b *ImageBuilder) LinkBlob(digest, cid string) {
+	b.links[digest] = cid
+}
+
+func (b *ImageBuilder) open(path string) (files.Node, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := files.NewSerialFile(path, false, stat)
+	if err != nil {
+		return nil, err
+	}
+	b.closers = append(b.closers, f)
+	return f, nil
+}
+
+// Close releases the readers and files held by the builder
+func (b *ImageBuilder) Close() error {
+	var err error
+	for _, c := range b.closers {
+		if e := c.Close(); e != nil {
+			err = e
+		}
+	}
+	b.closers = nil
+	for _, repo := range b.repos {
+		if e := repo.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// dedupe removes blobs of repositories that are already added by the root or another
+// repository and returns them as links from their paths to the path of the added blob.
+func (b *ImageBuilder) dedupe() map[string]string {
+	added := map[string]string{}
+	for digest := range b.blobs {
+		added[digest] = "blobs/" + digest
+	}
+	dups := map[string]string{}
+	var paths []string
+	for path := range b.repos {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		repo := b.repos[path]
+		for digest := range repo.blobs {
+			p := path + "/blobs/" + digest
+			if first, ok := added[digest]; ok {
+				delete(repo.blobs, digest)
+				dups[p] = first
+				continue
+			}
+			added[digest] = p
+		}
+	}
+	return dups
+}
+
+// directory returns the manifests and blobs of the builder and its repositories as a directory tree
+func (b *ImageBuilder) directory() files.Directory {
+	entries := map[string]files.Node{}
+	if len(b.manifests) > 0 || len(b.blobs) > 0 || len(b.repos) == 0 {
+		entries["blobs"] = files.NewMapDirectory(b.blobs)
+		entries["manifests"] = files.NewMapDirectory(b.manifests)
+	}
+
+	// nest repository paths, e.g. library/app -> library -> app
+	tree := map[string]interface{}{}
+	for path, repo := range b.repos {
+		node := tree
+		parts := strings.Split(path, "/")
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[part] = child
+			}
+			node = child
+		}
+		node[parts[len(parts)-1]] = repo
+	}
+	var build func(tree map[string]interface{}, entries map[string]files.Node) files.Directory
+	build = func(tree map[string]interface{}, entries map[string]files.Node) files.Directory {
+		for name, v := range tree {
+			switch v := v.(type) {
+			case *ImageBuilder:
+				entries[name] = v.directory()
+			case map[string]interface{}:
+				entries[name] = build(v, map[string]files.Node{})
+			}
+		}
+		return files.NewMapDirectory(entries)
+	}
+	return build(tree, entries)
+}
+
+// allLinks returns the blobs linked by CID of the builder and its repositories, path -> CID
+func (b *ImageBuilder) allLinks() map[string]string {
+	links := map[string]string{}
+	for digest, cid := range b.links {
+		links["blobs/"+digest] = cid
+	}
+	for path, repo := range b.repos {
+		for digest, cid := range repo.links {
+			links[path+"/blobs/"+digest] = cid
+		}
+	}
+	return links
+}
+
+// BuildImage adds the image collected by the builder and returns the CID of the image directory.
+// The image is not pinned, see Pin. The builder is closed afterwards.
+func (client *Client) BuildImage(b *ImageBuilder) (string, error) {
+	defer b.Close()
+
+	dups := b.dedupe()
+	sf := b.directory()
+	slf := files.NewSliceDirectory([]files.DirEntry{files.FileEntry("image", sf)})
+
+	reader := files.NewMultiFileReader(slf, true)
+	// only the final directory, after linking blobs, is worth pinning
+	resp, err := client.addRequest().
+		Option("pin", false).
+		Body(reader).
+		Send(context.Background())
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return "", resp.Error
+	}
+
+	// CIDs of the added files by path, to link shared blobs
+	added := map[string]string{}
+	dec := json.NewDecoder(resp.Output)
+	var final string
+	for {
+		var out object
+		err = dec.Decode(&out)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", err
+		}
+		added[strings.TrimPrefix(out.Name, "image/")] = out.Hash
+		final = out.Hash
+	}
+
+	if final == "" {
+		return "", errors.New("no results received")
+	}
+
+	// link existing blobs into the image directory
+	links := b.allLinks()
+	for path, first := range dups {
+		cid, ok := added[first]
+		if !ok {
+			return "", fmt.Errorf("no CID received for %s", first)
+		}
+		links[path] = cid
+	}
+	paths := make([]string, 0, len(links))
+	for path := range links {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		final, err = client.client.PatchLink(final, path, links[path], true)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return final, nil
+}
@@ -0,0 +1,95 @@
+package ipfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestImageBuilderRepositories(t *testing.T) {
+	var added, linked []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v0/add":
+			_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			mr := multipart.NewReader(r.Body, params["boundary"])
+			enc := json.NewEncoder(w)
+			for {
+				part, err := mr.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+				name, _ := url.QueryUnescape(params["filename"])
+				b, _ := ioutil.ReadAll(part)
+				if part.Header.Get("Content-Type") != "application/x-directory" {
+					added = append(added, name)
+					enc.Encode(object{Name: name, Hash: "Qm" + string(b)})
+				}
+			}
+			enc.Encode(object{Name: "image", Hash: "QmRoot"})
+		case "/api/v0/object/patch/add-link":
+			args := r.URL.Query()["arg"]
+			linked = append(linked, args[1]+"="+args[2])
+			json.NewEncoder(w).Encode(object{Hash: "QmPatched"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	client := NewRemoteClient(&Config{Host: strings.TrimPrefix(api.URL, "http://")})
+
+	b := NewImageBuilder()
+	app := b.Repository("library/app")
+	app.AddManifest("v1", []byte("app"))
+	app.AddBlob("sha256:base", strings.NewReader("base"))
+	app.AddBlob("sha256:app", strings.NewReader("app"))
+	tool := b.Repository("/org/tool/")
+	tool.AddManifest("v2", []byte("tool"))
+	tool.AddBlob("sha256:base", strings.NewReader("base"))
+	tool.LinkBlob("sha256:published", "QmPublished")
+	if b.Repository("library/app") != app {
+		t.Error("expected the same repository builder")
+	}
+
+	hash, err := client.BuildImage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != "QmPatched" {
+		t.Errorf("want %v, got %v", "QmPatched", hash)
+	}
+
+	sort.Strings(added)
+	want := []string{
+		"image/library/app/blobs/sha256:app",
+		"image/library/app/blobs/sha256:base",
+		"image/library/app/manifests/v1",
+		"image/org/tool/manifests/v2",
+	}
+	if fmt.Sprint(added) != fmt.Sprint(want) {
+		t.Errorf("want %v, got %v", want, added)
+	}
+
+	// the shared blob is streamed once and linked into the other repository
+	want = []string{
+		"org/tool/blobs/sha256:base=Qmbase",
+		"org/tool/blobs/sha256:published=QmPublished",
+	}
+	if fmt.Sprint(linked) != fmt.Sprint(want) {
+		t.Errorf("want %v, got %v", want, linked)
+	}
+}
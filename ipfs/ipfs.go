@@ -1,6 +1,7 @@
 package ipfs
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -11,7 +12,9 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	api "github.com/ipfs/go-ipfs-api"
@@ -25,12 +28,18 @@ type Client struct {
 	isRemote   bool
 	host       string
 	gatewayURL string
+	gateways   *GatewayPool
+	once       sync.Once
 }
 
 // Config is the config for the client
 type Config struct {
 	Host       string
 	GatewayURL string
+	// GatewayURLs are additional gateways to fail over to
+	GatewayURLs []string
+	// RaceGateways requests content from all gateways at once
+	RaceGateways bool
 }
 
 // NewClient returns a new IPFS client instance
@@ -68,11 +77,22 @@ func NewRemoteClient(config *Config) *Client {
 		}
 	}
 
+	var gateways []string
+	for _, u := range append([]string{config.GatewayURL}, config.GatewayURLs...) {
+		if u != "" {
+			gateways = append(gateways, NormalizeGatewayURL(u))
+		}
+	}
+
 	return &Client{
 		client:     client,
 		isRemote:   true,
 		host:       host,
 		gatewayURL: config.GatewayURL,
+		gateways: NewGatewayPool(&GatewayPoolConfig{
+			URLs: gateways,
+			Race: config.RaceGateways,
+		}),
 	}
 }
 
@@ -81,6 +101,23 @@ func (client *Client) Cat(path string) (io.ReadCloser, error) {
 	return client.client.Cat(path)
 }
 
+// CatRange returns length bytes of the content at the given path starting at offset.
+// A negative length reads to the end. Callers need to drain and close the returned reader after usage.
+func (client *Client) CatRange(path string, offset, length int64) (io.ReadCloser, error) {
+	req := client.client.Request("cat", path).Option("offset", offset)
+	if length >= 0 {
+		req.Option("length", length)
+	}
+	resp, err := req.Send(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp.Output, nil
+}
+
 // Get fetches the contents and outputs into a directory
 func (client *Client) Get(hash, outdir string) error {
 	return client.client.Get(hash, outdir)
@@ -91,6 +128,82 @@ func (client *Client) List(path string) ([]*api.LsLink, error) {
 	return client.client.List(path)
 }
 
+// ResolvePath resolves an IPFS path, e.g. /ipfs/<cid>/blobs/<digest>, to the CID it points to
+func (client *Client) ResolvePath(path string) (string, error) {
+	return client.client.ResolvePath(path)
+}
+
+// Pin pins the content of the CID recursively so that garbage collection on the IPFS node keeps it
+func (client *Client) Pin(cid string) error {
+	return client.client.Pin(cid)
+}
+
+// Unpin removes the recursive pin of the CID, content also referenced by other pins is kept
+func (client *Client) Unpin(cid string) error {
+	return client.client.Unpin(cid)
+}
+
+// Addresses returns the multiaddrs the IPFS node listens on, so that peers can connect to it
+func (client *Client) Addresses() ([]string, error) {
+	id, err := client.client.ID()
+	if err != nil {
+		return nil, err
+	}
+	return id.Addresses, nil
+}
+
+// Pins returns the CIDs pinned recursively on the IPFS node
+func (client *Client) Pins() ([]string, error) {
+	var out struct {
+		Keys map[string]api.PinInfo
+	}
+	if err := client.client.Request("pin/ls").Option("type", api.RecursivePin).Exec(context.Background(), &out); err != nil {
+		return nil, err
+	}
+	cids := make([]string, 0, len(out.Keys))
+	for cid := range out.Keys {
+		cids = append(cids, cid)
+	}
+	sort.Strings(cids)
+	return cids, nil
+}
+
+// FileSize returns the size of the file at the given path
+func (client *Client) FileSize(path string) (int64, error) {
+	var out struct {
+		Size int64
+	}
+	if err := client.client.Request("files/stat", path).Exec(context.Background(), &out); err != nil {
+		return 0, err
+	}
+	return out.Size, nil
+}
+
+// FileHash returns the CID of the file or directory at the given MFS path
+func (client *Client) FileHash(path string) (string, error) {
+	var out struct {
+		Hash string
+	}
+	if err := client.client.Request("files/stat", path).Exec(context.Background(), &out); err != nil {
+		return "", err
+	}
+	return out.Hash, nil
+}
+
+// WriteFile writes the data to the file at the given MFS path, creating the file and its parent
+// directories if needed. Content in MFS is kept by garbage collection without pins.
+func (client *Client) WriteFile(path string, data []byte) error {
+	sf := files.NewSliceDirectory([]files.DirEntry{files.FileEntry("", files.NewBytesFile(data))})
+	return client.client.Request("files/write", path).
+		Option("create", true).
+		Option("parents", true).
+		Option("truncate", true).
+		Option("cid-version", 1).
+		Option("raw-leaves", true).
+		Body(files.NewMultiFileReader(sf, true)).
+		Exec(context.Background(), nil)
+}
+
 // AddDir adds a directory to IPFS
 // https://github.com/ipfs/go-ipfs-api/blob/master/add.go#L99-L145
 func (client *Client) AddDir(dir string) (string, error) {
@@ -106,9 +219,7 @@ func (client *Client) AddDir(dir string) (string, error) {
 	slf := files.NewSliceDirectory([]files.DirEntry{files.FileEntry(filepath.Base(dir), sf)})
 	reader := files.NewMultiFileReader(slf, true)
 
-	resp, err := client.client.Request("add").
-		Option("recursive", true).
-		Option("cid-version", 1).
+	resp, err := client.addRequest().
 		Body(reader).
 		Send(context.Background())
 	if err != nil {
@@ -142,6 +253,17 @@ func (client *Client) AddDir(dir string) (string, error) {
 	return final, nil
 }
 
+// addRequest returns an add request with the options that determine CIDs set explicitly,
+// so that the same content gets the same CID regardless of the defaults of the IPFS node
+func (client *Client) addRequest() *api.RequestBuilder {
+	return client.client.Request("add").
+		Option("recursive", true).
+		Option("cid-version", 1).
+		Option("raw-leaves", true).
+		Option("chunker", "size-262144").
+		Option("hash", "sha2-256")
+}
+
 // Refs returns the refs of an IPFS hash
 func (client *Client) Refs(hash string, recursive bool) (<-chan string, error) {
 	if client.isRemote {
@@ -151,16 +273,32 @@ func (client *Client) Refs(hash string, recursive bool) (<-chan string, error) {
 	return client.client.Refs(hash, recursive)
 }
 
-// GatewayURL returns the gateway URL
+// GatewayURL returns the gateway URL, the healthiest one if several gateways are configured
 func (client *Client) GatewayURL() string {
-	if client.gatewayURL == "" {
+	return client.GatewayURLs()[0]
+}
+
+// GatewayURLs returns the gateway URLs, healthy gateways first
+func (client *Client) GatewayURLs() []string {
+	return client.Gateways().URLs()
+}
+
+// Gateways returns the pool of gateways used to retrieve content. The gateway
+// the host is configured to use is taken if none are configured.
+func (client *Client) Gateways() *GatewayPool {
+	client.once.Do(func() {
+		if client.gateways != nil && len(client.gateways.gateways) > 0 {
+			return
+		}
 		url, err := HostGatewayURL()
-		if err == nil {
-			return url
+		if err != nil {
+			url = NormalizeGatewayURL(client.gatewayURL)
 		}
-	}
-
-	return NormalizeGatewayURL(client.gatewayURL)
+		client.gateways = NewGatewayPool(&GatewayPoolConfig{
+			URLs: []string{url},
+		})
+	})
+	return client.gateways
 }
 
 // remoteRefs returns refs using the IPFS API
@@ -202,62 +340,23 @@ func (client *Client) remoteRefs(hash string, recursive bool) (<-chan string, er
 }
 
 type object struct {
+	Name string
 	Hash string
 }
 
 // AddImage adds components of an image recursively
+//
+// Deprecated: AddImage holds every layer in memory, use an ImageBuilder with BuildImage instead.
 func (client *Client) AddImage(manifest map[string][]byte, layers map[string][]byte) (string, error) {
-	mf := make(map[string]files.Node)
+	b := NewImageBuilder()
 	for k, v := range manifest {
-		mf[k] = files.NewBytesFile(v)
+		b.AddManifest(k, v)
 	}
-
-	bf := make(map[string]files.Node)
 	for k, v := range layers {
-		bf[k] = files.NewBytesFile(v)
-	}
-
-	sf := files.NewMapDirectory(map[string]files.Node{
-		"blobs":     files.NewMapDirectory(bf),
-		"manifests": files.NewMapDirectory(mf),
-	})
-	slf := files.NewSliceDirectory([]files.DirEntry{files.FileEntry("image", sf)})
-
-	reader := files.NewMultiFileReader(slf, true)
-	resp, err := client.client.Request("add").
-		Option("recursive", true).
-		Option("cid-version", 1).
-		Body(reader).
-		Send(context.Background())
-	if err != nil {
-		return "", nil
-	}
-
-	defer resp.Close()
-
-	if resp.Error != nil {
-		return "", resp.Error
+		b.AddBlob(k, bytes.NewReader(v))
 	}
 
-	dec := json.NewDecoder(resp.Output)
-	var final string
-	for {
-		var out object
-		err = dec.Decode(&out)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return "", err
-		}
-		final = out.Hash
-	}
-
-	if final == "" {
-		return "", errors.New("no results received")
-	}
-
-	return final, nil
+	return client.BuildImage(b)
 }
 
 // RunDaemon runs the IPFS daemon
@@ -0,0 +1,83 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	api "github.com/ipfs/go-ipfs-api"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// ErrKeyNotFound is error for when a key is not in the keystore of the IPFS node
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrNameNotFound is error for when an IPNS name has no record, e.g. it has never been published
+var ErrNameNotFound = errors.New("name not found")
+
+// errNotFound is the code of not found errors of the IPFS node API
+const errNotFound = 3
+
+// errResolveFailed is the error of the IPFS node API for names without a record, which it
+// reports with the code of generic errors and often with context, e.g. could not resolve name: ...
+const errResolveFailed = "could not resolve name"
+
+// KeyID returns the IPNS name of a key of the keystore of the IPFS node, e.g. self
+func (client *Client) KeyID(name string) (string, error) {
+	var out struct {
+		Keys []struct {
+			Name string
+			ID   string `json:"Id"`
+		}
+	}
+	if err := client.client.Request("key/list").Exec(context.Background(), &out); err != nil {
+		return "", err
+	}
+	for _, k := range out.Keys {
+		if k.Name == name {
+			return k.ID, nil
+		}
+	}
+	return "", ErrKeyNotFound
+}
+
+// ResolveName resolves an IPNS name, e.g. /ipns/<name>, to the IPFS path it is published with.
+// It returns ErrNameNotFound if the name has no record.
+func (client *Client) ResolveName(name string) (string, error) {
+	path, err := client.client.Resolve(name)
+	if e, ok := err.(*api.Error); ok && (e.Code == errNotFound || strings.Contains(e.Message, errResolveFailed)) {
+		return "", ErrNameNotFound
+	}
+	return path, err
+}
+
+// Publish publishes the IPFS path under the IPNS name of the key and returns the name
+func (client *Client) Publish(key, path string) (string, error) {
+	resp, err := client.client.PublishWithDetails(path, key, 0, 0, false)
+	if err != nil {
+		return "", err
+	}
+	return resp.Name, nil
+}
+
+// NewDir returns the CID of an empty directory
+func (client *Client) NewDir() (string, error) {
+	return client.client.NewObject("unixfs-dir")
+}
+
+// AddLink links the CID at the path of the directory, creating intermediate directories, and
+// returns the CID of the updated directory. A link already at the path is replaced.
+func (client *Client) AddLink(root, path, cid string) (string, error) {
+	return client.client.PatchLink(root, strings.Trim(path, "/"), cid, true)
+}
+
+// AddBytes adds the data as a file and returns its CID, the file is not pinned
+func (client *Client) AddBytes(data []byte) (string, error) {
+	sf := files.NewSliceDirectory([]files.DirEntry{files.FileEntry("", files.NewBytesFile(data))})
+	var out object
+	err := client.addRequest().
+		Option("pin", false).
+		Body(files.NewMultiFileReader(sf, true)).
+		Exec(context.Background(), &out)
+	return out.Hash, err
+}
@@ -32,11 +32,44 @@ var defaultTransport = &http.Transport{
 	ExpectContinueTimeout: 1 * time.Second,
 }
 
+// Client for large bodies that are copied through as they arrive.
+// There is no overall timeout; only connecting and waiting for the
+// response headers are bounded.
+var streamClient = &http.Client{
+	Transport: streamTransport,
+}
+
+var streamTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		DualStack: true,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          10,
+	IdleConnTimeout:       30 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
 // Get issues a GET to the specified URL - a drop-in replacement for http.Get with timeouts.
 func Get(url string) (resp *http.Response, err error) {
 	return defaultClient.Get(url)
 }
 
+// Do sends an HTTP request - a drop-in replacement for http.DefaultClient.Do with timeouts.
+func Do(req *http.Request) (resp *http.Response, err error) {
+	return defaultClient.Do(req)
+}
+
+// Stream sends an HTTP request for a body that may be too large
+// to be read within the default timeout. Callers must close the body.
+func Stream(req *http.Request) (resp *http.Response, err error) {
+	return streamClient.Do(req)
+}
+
 // GetFreePort asks the kernel for a free open port that is ready to use.
 func GetFreePort() (int, error) {
 	ip, err := LocalIP()
@@ -0,0 +1,199 @@
+// Package pinning is a client of remote pinning services implementing the IPFS Pinning Service API,
+// https://ipfs.github.io/pinning-services-api-spec/
+package pinning
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	netutil "github.com/ipdr/ipdr/netutil"
+)
+
+// Pin statuses reported by the pinning service
+const (
+	StatusQueued  = "queued"
+	StatusPinning = "pinning"
+	StatusPinned  = "pinned"
+	StatusFailed  = "failed"
+)
+
+var (
+	// ErrTimeout is error for when the pin is not pinned within the timeout
+	ErrTimeout = errors.New("timed out waiting for the pin")
+	// ErrPinFailed is error for when the pinning service failed to pin
+	ErrPinFailed = errors.New("pinning service failed to pin")
+)
+
+// Client is the client of a pinning service
+type Client struct {
+	endpoint     string
+	token        string
+	pollInterval time.Duration
+	timeout      time.Duration
+}
+
+// Config is the config for the client
+type Config struct {
+	// Endpoint is the URL of the API, e.g. https://api.pinata.cloud/psa
+	Endpoint string
+	// Token is the access token sent as a bearer token, requests are unauthenticated without it
+	Token string
+	// PollInterval is the time between pin status requests, 2 seconds by default
+	PollInterval time.Duration
+	// Timeout bounds waiting for a pin to be pinned, 10 minutes by default
+	Timeout time.Duration
+}
+
+// Pin is a CID to pin
+type Pin struct {
+	CID     string            `json:"cid"`
+	Name    string            `json:"name,omitempty"`
+	Origins []string          `json:"origins,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// PinStatus is the status of a pin request
+type PinStatus struct {
+	RequestID string            `json:"requestid"`
+	Status    string            `json:"status"`
+	Created   time.Time         `json:"created"`
+	Pin       Pin               `json:"pin"`
+	Delegates []string          `json:"delegates"`
+	Info      map[string]string `json:"info,omitempty"`
+}
+
+// Error is an error response of the pinning service
+type Error struct {
+	StatusCode int
+	Reason     string `json:"reason"`
+	Details    string `json:"details"`
+}
+
+func (e *Error) Error() string {
+	if e.Details != "" {
+		return fmt.Sprintf("pinning service: %d %s: %s", e.StatusCode, e.Reason, e.Details)
+	}
+	return fmt.Sprintf("pinning service: %d %s", e.StatusCode, e.Reason)
+}
+
+// NewClient returns a new pinning service client instance
+func NewClient(config *Config) *Client {
+	if config == nil {
+		config = &Config{}
+	}
+
+	pollInterval := config.PollInterval
+	if pollInterval == 0 {
+		pollInterval = 2 * time.Second
+	}
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Minute
+	}
+
+	return &Client{
+		endpoint:     strings.TrimSuffix(config.Endpoint, "/"),
+		token:        config.Token,
+		pollInterval: pollInterval,
+		timeout:      timeout,
+	}
+}
+
+// Add submits a pin request and returns its status
+func (c *Client) Add(pin *Pin) (*PinStatus, error) {
+	body, err := json.Marshal(pin)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(http.MethodPost, "/pins", body)
+}
+
+// Status returns the status of a pin request
+func (c *Client) Status(requestID string) (*PinStatus, error) {
+	return c.do(http.MethodGet, "/pins/"+url.PathEscape(requestID), nil)
+}
+
+// Wait polls the status of a pin request until it is pinned, failed or the timeout expires.
+// The last status received is returned along with ErrPinFailed or ErrTimeout.
+func (c *Client) Wait(status *PinStatus) (*PinStatus, error) {
+	deadline := time.Now().Add(c.timeout)
+	for {
+		switch status.Status {
+		case StatusPinned:
+			return status, nil
+		case StatusFailed:
+			return status, ErrPinFailed
+		}
+		if time.Now().Add(c.pollInterval).After(deadline) {
+			return status, ErrTimeout
+		}
+		time.Sleep(c.pollInterval)
+
+		next, err := c.Status(status.RequestID)
+		if err != nil {
+			return status, err
+		}
+		status = next
+	}
+}
+
+// PinAndWait submits a pin request for the CID and waits until it is pinned.
+// Origins are the multiaddrs of the node providing the content, the service connects to them
+// to fetch it instead of finding providers through the DHT.
+func (c *Client) PinAndWait(cid, name string, origins []string) (*PinStatus, error) {
+	status, err := c.Add(&Pin{CID: cid, Name: name, Origins: origins})
+	if err != nil {
+		return nil, err
+	}
+	return c.Wait(status)
+}
+
+// do sends a request to the API and decodes the pin status of the response
+func (c *Client) do(method, path string, body []byte) (*PinStatus, error) {
+	req, err := http.NewRequest(method, c.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := netutil.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var failure struct {
+			Error Error `json:"error"`
+		}
+		if err := json.Unmarshal(data, &failure); err != nil || failure.Error.Reason == "" {
+			failure.Error.Reason = http.StatusText(resp.StatusCode)
+		}
+		failure.Error.StatusCode = resp.StatusCode
+		return nil, &failure.Error
+	}
+
+	var status PinStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
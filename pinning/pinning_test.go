@@ -0,0 +1,131 @@
+package pinning
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pinningService is a stand-in pinning service, the status of a pin
+// advances through the statuses of its CID on every status request
+type pinningService struct {
+	statuses map[string][]string
+	pins     map[string]*PinStatus
+	// auth is the Authorization header of the last request
+	auth string
+	lock sync.Mutex
+}
+
+func (s *pinningService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.auth = req.Header.Get("Authorization")
+	if s.auth != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":{"reason":"UNAUTHORIZED","details":"Access token is missing or invalid"}}`)
+		return
+	}
+
+	switch {
+	case req.Method == http.MethodPost && req.URL.Path == "/pins":
+		var pin Pin
+		if err := json.NewDecoder(req.Body).Decode(&pin); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		status := &PinStatus{
+			RequestID: fmt.Sprintf("req-%d", len(s.pins)),
+			Status:    StatusQueued,
+			Created:   time.Now(),
+			Pin:       pin,
+			Delegates: []string{},
+		}
+		s.pins[status.RequestID] = status
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(status)
+	case req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/pins/"):
+		status, ok := s.pins[strings.TrimPrefix(req.URL.Path, "/pins/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"reason":"NOT_FOUND"}}`)
+			return
+		}
+		if next := s.statuses[status.Pin.CID]; len(next) > 0 {
+			status.Status, s.statuses[status.Pin.CID] = next[0], next[1:]
+		}
+		json.NewEncoder(w).Encode(status)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestPinAndWait(t *testing.T) {
+	service := &pinningService{
+		statuses: map[string][]string{
+			"bafypinned":  {StatusPinning, StatusPinned},
+			"bafyfailed":  {StatusPinning, StatusFailed},
+			"bafyqueued":  {StatusQueued, StatusQueued, StatusQueued, StatusQueued, StatusQueued, StatusQueued},
+			"bafyinstant": {},
+		},
+		pins: map[string]*PinStatus{},
+	}
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	client := NewClient(&Config{
+		Endpoint:     server.URL + "/",
+		Token:        "secret",
+		PollInterval: time.Millisecond,
+		Timeout:      5 * time.Millisecond,
+	})
+
+	for i, tt := range []struct {
+		cid    string
+		status string
+		err    error
+	}{
+		{"bafypinned", StatusPinned, nil},
+		{"bafyfailed", StatusFailed, ErrPinFailed},
+		{"bafyqueued", StatusQueued, ErrTimeout},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			origins := []string{"/ip4/203.0.113.1/tcp/4001/p2p/12D3KooWnode"}
+			status, err := client.PinAndWait(tt.cid, "app:v1", origins)
+			if err != tt.err {
+				t.Fatalf("want %v, got %v", tt.err, err)
+			}
+			if status.Status != tt.status {
+				t.Errorf("want %v, got %v", tt.status, status.Status)
+			}
+			if status.Pin.CID != tt.cid {
+				t.Errorf("want %v, got %v", tt.cid, status.Pin.CID)
+			}
+			if status.Pin.Name != "app:v1" {
+				t.Errorf("want %v, got %v", "app:v1", status.Pin.Name)
+			}
+			if fmt.Sprint(status.Pin.Origins) != fmt.Sprint(origins) {
+				t.Errorf("want %v, got %v", origins, status.Pin.Origins)
+			}
+		})
+	}
+
+	if _, err := client.Status("missing"); err == nil || err.(*Error).Reason != "NOT_FOUND" {
+		t.Errorf("want %v, got %v", "NOT_FOUND", err)
+	}
+
+	unauthorized := NewClient(&Config{Endpoint: server.URL})
+	_, err := unauthorized.PinAndWait("bafyinstant", "", nil)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusUnauthorized || e.Reason != "UNAUTHORIZED" {
+		t.Errorf("want %v, got %v", "UNAUTHORIZED", err)
+	}
+	// no token, no bearer credentials
+	if service.auth != "" {
+		t.Errorf("want %q, got %q", "", service.auth)
+	}
+}
@@ -0,0 +1,164 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/ipdr/ipdr/server/registry/image"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Layer compression algorithms
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+)
+
+// ErrUnknownCompression is error for when the layer compression is not supported
+var ErrUnknownCompression = errors.New("compression must be \"gzip\", \"zstd\" or \"none\"")
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compressedLayer is a layer blob written by compressLayer
+type compressedLayer struct {
+	size        int64
+	digest      string
+	compression string
+}
+
+// mediaType returns the media type of the layer for a Docker or an OCI manifest
+func (l *compressedLayer) mediaType(oci bool) string {
+	switch {
+	case l.compression == CompressionZstd:
+		return image.OCIZstdLayerType
+	case l.compression == CompressionNone && oci:
+		return image.OCIUncompressedLayerType
+	case l.compression == CompressionNone:
+		return image.UncompressedLayerType
+	case oci:
+		return image.OCILayerType
+	}
+	return image.LayerType
+}
+
+// compressLayer streams the layer at path into blobDir, compressed with the configured
+// algorithm. Layers that are already compressed are stored as they are so that their digests are kept.
+func (r *Registry) compressLayer(path, blobDir string) (*compressedLayer, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	br := bufio.NewReader(src)
+	magic, _ := br.Peek(len(zstdMagic))
+	compression := r.compression
+	// layers that are already compressed are written through as they are
+	var compressed bool
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		compression, compressed = CompressionGzip, true
+		r.Debugf("[registry] reusing gzip compressed layer: %s", path)
+	case bytes.HasPrefix(magic, zstdMagic):
+		compression, compressed = CompressionZstd, true
+		r.Debugf("[registry] reusing zstd compressed layer: %s", path)
+	default:
+		r.Debugf("[registry] compressing layer with %s: %s", compression, path)
+	}
+
+	tmp, err := ioutil.TempFile(blobDir, "layer")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	cw := &countWriter{w: io.MultiWriter(tmp, h)}
+
+	var w io.WriteCloser
+	if compressed || compression == CompressionNone {
+		w = nopWriteCloser{cw}
+	} else if w, err = newCompressor(cw, compression, r.compressionLevel); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, br); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return nil, err
+	}
+
+	digest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if err := renameFile(tmp.Name(), fmt.Sprintf("%s/%s", blobDir, digest)); err != nil {
+		return nil, err
+	}
+
+	return &compressedLayer{
+		size:        cw.n,
+		digest:      digest,
+		compression: compression,
+	}, nil
+}
+
+// newCompressor returns a writer compressing to w. A level of 0 uses the default level.
+func newCompressor(w io.Writer, compression string, level int) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		gw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		// no name or modification time, so that the same layer compresses to the same bytes
+		gw.Header = gzip.Header{OS: 255}
+		return gw, nil
+	case CompressionZstd:
+		// a single encoder goroutine keeps the output independent of the number of CPUs
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	}
+	return nil, ErrUnknownCompression
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,107 @@
+package registry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipdr/ipdr/server/registry/image"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	layer := bytes.Repeat([]byte("layer contents "), 1000)
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(layer)
+	gw.Close()
+	var zs bytes.Buffer
+	zw, _ := zstd.NewWriter(&zs)
+	zw.Write(layer)
+	zw.Close()
+
+	gunzip := func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+	unzstd := func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }
+	none := func(r io.Reader) (io.Reader, error) { return r, nil }
+
+	for i, tt := range []struct {
+		in          []byte
+		compression string
+		level       int
+		want        string
+		mediaType   string
+		decompress  func(io.Reader) (io.Reader, error)
+		// the layer is stored as it is
+		reused bool
+	}{
+		{layer, CompressionGzip, 0, CompressionGzip, image.LayerType, gunzip, false},
+		{layer, CompressionGzip, gzip.BestSpeed, CompressionGzip, image.LayerType, gunzip, false},
+		{layer, CompressionZstd, 0, CompressionZstd, image.OCIZstdLayerType, unzstd, false},
+		{layer, CompressionNone, 0, CompressionNone, image.UncompressedLayerType, none, true},
+		{gz.Bytes(), CompressionZstd, 0, CompressionGzip, image.LayerType, gunzip, true},
+		{zs.Bytes(), CompressionGzip, 0, CompressionZstd, image.OCIZstdLayerType, unzstd, true},
+		{gz.Bytes(), CompressionGzip, 0, CompressionGzip, image.LayerType, gunzip, true},
+		{zs.Bytes(), CompressionZstd, 0, CompressionZstd, image.OCIZstdLayerType, unzstd, true},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			src := filepath.Join(dir, fmt.Sprintf("layer%v.tar", i))
+			if err := ioutil.WriteFile(src, tt.in, 0644); err != nil {
+				t.Fatal(err)
+			}
+			r := &Registry{compression: tt.compression, compressionLevel: tt.level}
+			l, err := r.compressLayer(src, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l.compression != tt.want {
+				t.Errorf("want %v, got %v", tt.want, l.compression)
+			}
+			if mediaType := l.mediaType(false); mediaType != tt.mediaType {
+				t.Errorf("want %v, got %v", tt.mediaType, mediaType)
+			}
+
+			b, err := ioutil.ReadFile(filepath.Join(dir, l.digest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if digestOf(b) != l.digest {
+				t.Errorf("want %v, got %v", digestOf(b), l.digest)
+			}
+			if int64(len(b)) != l.size {
+				t.Errorf("want %v, got %v", len(b), l.size)
+			}
+			if tt.reused != bytes.Equal(b, tt.in) {
+				t.Errorf("want %v, got %v", tt.reused, !tt.reused)
+			}
+
+			dr, err := tt.decompress(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := ioutil.ReadAll(dr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, layer) {
+				t.Error("want decompressed layer to match")
+			}
+		})
+	}
+
+	r := &Registry{compression: "lz4"}
+	src := filepath.Join(dir, "layer0.tar")
+	if _, err := r.compressLayer(src, dir); err != ErrUnknownCompression {
+		t.Errorf("want %v, got %v", ErrUnknownCompression, err)
+	}
+}
@@ -0,0 +1,321 @@
+package registry
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ipdr/ipdr/server/registry/image"
+)
+
+const (
+	// ExportDocker exports an image as a tarball that can be loaded with `docker load`
+	ExportDocker = "docker"
+	// ExportOCI exports an image as an OCI image layout directory
+	ExportOCI = "oci"
+)
+
+// ErrUnknownExportFormat is error for when the export format is not supported
+var ErrUnknownExportFormat = errors.New("export format must be \"docker\" or \"oci\"")
+
+// dockerArchiveManifest is an entry of the manifest.json of a `docker save` tarball
+type dockerArchiveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// ExportImage writes the image published on IPFS under ipfsHash to path in the given format.
+// The tag selects the manifest of the image, defaulting to latest, and repoTag
+// names the image of a Docker tarball, e.g. name:tag.
+func (r *Registry) ExportImage(ipfsHash, tag, format, path, repoTag string) error {
+	switch format {
+	case ExportOCI:
+		return r.ExportOCILayout(ipfsHash, tag, path)
+	case ExportDocker:
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if err := r.ExportDockerArchive(ipfsHash, tag, repoTag, f); err != nil {
+			f.Close()
+			os.Remove(path)
+			return err
+		}
+		return f.Close()
+	}
+	return ErrUnknownExportFormat
+}
+
+// ExportOCILayout writes the image published on IPFS under ipfsHash to an OCI image layout directory.
+// Indexes are exported with the images of all platforms.
+func (r *Registry) ExportOCILayout(ipfsHash, tag, dir string) error {
+	if tag == "" {
+		tag = "latest"
+	}
+
+	data, err := r.readManifest(ipfsHash, tag)
+	if err != nil {
+		return err
+	}
+	mf, err := image.DecodeManifest(data)
+	if err != nil {
+		return err
+	}
+
+	digest := digestOf(data)
+	if err := writeBlob(dir, digest, data); err != nil {
+		return err
+	}
+	if err := r.exportOCIBlobs(ipfsHash, dir, mf); err != nil {
+		return err
+	}
+
+	index := ociIndex{
+		SchemaVersion: image.ManifestVersion,
+		Manifests: []*ociDescriptor{{
+			Descriptor: image.Descriptor{
+				MediaType: mf.MediaType,
+				Size:      int64(len(data)),
+				Digest:    digest,
+			},
+			Annotations: map[string]string{refNameAnnotation: tag},
+		}},
+	}
+	if err := writeJSON(index, filepath.Join(dir, "index.json")); err != nil {
+		return err
+	}
+	return writeJSON(map[string]string{"imageLayoutVersion": "1.0.0"}, filepath.Join(dir, "oci-layout"))
+}
+
+// exportOCIBlobs writes the platform manifests and blobs referenced by a manifest to the layout
+func (r *Registry) exportOCIBlobs(ipfsHash, dir string, mf *image.Manifest) error {
+	for _, d := range mf.ManifestDigests() {
+		data, err := r.readManifest(ipfsHash, d)
+		if err != nil {
+			return err
+		}
+		if err := writeBlob(dir, d, data); err != nil {
+			return err
+		}
+		child, err := image.DecodeManifest(data)
+		if err != nil {
+			return err
+		}
+		if err := r.exportOCIBlobs(ipfsHash, dir, child); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range mf.Digests() {
+		path, err := blobPath(dir, d)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err == nil {
+			// shared by several platforms
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := r.exportBlob(ipfsHash, d, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) exportBlob(ipfsHash, digest, path string) error {
+	rc, err := r.ipfsClient.Cat(fmt.Sprintf("/ipfs/%s/blobs/%s", ipfsHash, digest))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := copyVerified(f, rc, digest); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// ExportDockerArchive writes the image published on IPFS under ipfsHash as a tarball in
+// the format of `docker save`. Of an index, the image for linux/amd64 is exported.
+func (r *Registry) ExportDockerArchive(ipfsHash, tag, repoTag string, w io.Writer) error {
+	if tag == "" {
+		tag = "latest"
+	}
+
+	data, err := r.readManifest(ipfsHash, tag)
+	if err != nil {
+		return err
+	}
+	mf, err := image.DecodeManifest(data)
+	if err != nil {
+		return err
+	}
+	if mf.IsIndex() {
+		desc := mf.Match(image.DefaultPlatform)
+		if desc == nil {
+			return fmt.Errorf("no image for platform %s/%s", image.DefaultPlatform.OS, image.DefaultPlatform.Architecture)
+		}
+		if data, err = r.readManifest(ipfsHash, desc.Digest); err != nil {
+			return err
+		}
+		if mf, err = image.DecodeManifest(data); err != nil {
+			return err
+		}
+	}
+	if mf.Config == nil {
+		return errors.New("expected manifest to reference an image config")
+	}
+
+	entry := dockerArchiveManifest{
+		Config: hexOf(mf.Config.Digest) + ".json",
+	}
+	if repoTag != "" {
+		entry.RepoTags = []string{repoTag}
+	}
+
+	tw := tar.NewWriter(w)
+	if err := r.writeTarBlob(tw, ipfsHash, entry.Config, mf.Config.Digest, mf.Config.Size); err != nil {
+		return err
+	}
+	for _, l := range mf.Layers {
+		name := layerFileName(l.Digest, l.MediaType)
+		if err := r.writeTarBlob(tw, ipfsHash, name, l.Digest, l.Size); err != nil {
+			return err
+		}
+		entry.Layers = append(entry.Layers, name)
+	}
+
+	b, err := json.Marshal([]dockerArchiveManifest{entry})
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(tarHeader("manifest.json", int64(len(b)))); err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// layerFileName names a layer of a `docker save` archive after its digest,
+// with the extension of the compression of its media type
+func layerFileName(digest, mediaType string) string {
+	switch {
+	case strings.HasSuffix(mediaType, "gzip"):
+		return hexOf(digest) + ".tar.gz"
+	case strings.HasSuffix(mediaType, "zstd"):
+		return hexOf(digest) + ".tar.zst"
+	}
+	return hexOf(digest) + ".tar"
+}
+
+func (r *Registry) writeTarBlob(tw *tar.Writer, ipfsHash, name, digest string, size int64) error {
+	path := fmt.Sprintf("/ipfs/%s/blobs/%s", ipfsHash, digest)
+	if size <= 0 {
+		var err error
+		if size, err = r.ipfsClient.FileSize(path); err != nil {
+			return err
+		}
+	}
+
+	rc, err := r.ipfsClient.Cat(path)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := tw.WriteHeader(tarHeader(name, size)); err != nil {
+		return err
+	}
+	_, err = copyVerified(tw, io.LimitReader(rc, size), digest)
+	return err
+}
+
+// readManifest reads the manifest stored under a tag or digest of the image
+func (r *Registry) readManifest(ipfsHash, reference string) ([]byte, error) {
+	rc, err := r.ipfsClient.Cat(fmt.Sprintf("/ipfs/%s/manifests/%s", ipfsHash, reference))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(reference, "sha256:") && digestOf(data) != reference {
+		return nil, fmt.Errorf("digest mismatch: manifest %s", reference)
+	}
+	return data, nil
+}
+
+// copyVerified copies src to dst and fails if the content doesn't match the sha256 digest
+func copyVerified(dst io.Writer, src io.Reader, digest string) (int64, error) {
+	var h hash.Hash
+	if strings.HasPrefix(digest, "sha256:") {
+		h = sha256.New()
+		dst = io.MultiWriter(dst, h)
+	}
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		return n, err
+	}
+	if h != nil && "sha256:"+hex.EncodeToString(h.Sum(nil)) != digest {
+		return n, fmt.Errorf("digest mismatch: blob %s", digest)
+	}
+	return n, nil
+}
+
+func writeBlob(dir, digest string, data []byte) error {
+	path, err := blobPath(dir, digest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func tarHeader(name string, size int64) *tar.Header {
+	return &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Unix(0, 0),
+		Typeflag: tar.TypeReg,
+	}
+}
+
+// hexOf returns the encoded part of a digest, e.g. the hex of sha256:<hex>
+func hexOf(digest string) string {
+	if i := strings.Index(digest, ":"); i >= 0 {
+		return digest[i+1:]
+	}
+	return digest
+}
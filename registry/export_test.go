@@ -0,0 +1,165 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	ipfs "github.com/ipdr/ipdr/ipfs"
+)
+
+func TestExportImage(t *testing.T) {
+	// the image directory on IPFS, path -> content
+	content := map[string][]byte{}
+	addImage := func(img v1.Image) {
+		raw, _ := img.RawManifest()
+		digest, _ := img.Digest()
+		content["manifests/"+digest.String()] = raw
+		config, _ := img.RawConfigFile()
+		configDigest, _ := img.ConfigName()
+		content["blobs/"+configDigest.String()] = config
+		layers, _ := img.Layers()
+		for _, l := range layers {
+			d, _ := l.Digest()
+			rc, _ := l.Compressed()
+			b, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			content["blobs/"+d.String()] = b
+		}
+	}
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addImage(img)
+	raw, _ := img.RawManifest()
+	content["manifests/latest"] = raw
+
+	idx, err := random.Index(1024, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, _ := idx.IndexManifest()
+	for i, desc := range im.Manifests {
+		child, _ := idx.Image(desc.Digest)
+		addImage(child)
+		if i == 0 {
+			im.Manifests[i].Platform = &v1.Platform{OS: "linux", Architecture: "amd64"}
+		}
+	}
+	content["manifests/multi"], _ = json.Marshal(im)
+
+	ipfsAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path := strings.TrimPrefix(req.URL.Query().Get("arg"), "/ipfs/QmImage/")
+		b, ok := content[path]
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{"Message":"no link named %q","Code":0,"Type":"error"}`, path)
+			return
+		}
+		w.Write(b)
+	}))
+	defer ipfsAPI.Close()
+
+	r := &Registry{
+		ipfsClient: ipfs.NewRemoteClient(&ipfs.Config{
+			Host: strings.TrimPrefix(ipfsAPI.URL, "http://"),
+		}),
+	}
+
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, tag := range []string{"latest", "multi"} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			layout := filepath.Join(dir, tag)
+			if err := r.ExportImage("QmImage", tag, ExportOCI, layout, ""); err != nil {
+				t.Fatal(err)
+			}
+			exported, err := readOCILayout(layout, tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := digestOf(content["manifests/"+tag]); exported.digest != want {
+				t.Errorf("want %v, got %v", want, exported.digest)
+			}
+			for digest, path := range exported.blobs {
+				b, err := ioutil.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, content["blobs/"+digest]) {
+					t.Errorf("want blob %v to match", digest)
+				}
+			}
+
+			archive := filepath.Join(dir, tag+".tar")
+			if err := r.ExportImage("QmImage", tag, ExportDocker, archive, "app:"+tag); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := tarball.ImageFromPath(archive, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := img
+			if tag == "multi" {
+				want, _ = idx.Image(im.Manifests[0].Digest)
+			}
+			wantLayers, _ := want.Layers()
+			layers, err := loaded.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(layers) != len(wantLayers) {
+				t.Fatalf("want %v, got %v", len(wantLayers), len(layers))
+			}
+			for i := range layers {
+				got, _ := layers[i].Digest()
+				d, _ := wantLayers[i].Digest()
+				if got != d {
+					t.Errorf("want %v, got %v", d, got)
+				}
+			}
+		})
+	}
+
+	if err := r.ExportImage("QmImage", "missing", ExportDocker, filepath.Join(dir, "missing.tar"), ""); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.tar")); !os.IsNotExist(err) {
+		t.Errorf("want %v, got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestLayerFileName(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	for i, tt := range []struct {
+		mediaType string
+		name      string
+	}{
+		{"application/vnd.docker.image.rootfs.diff.tar.gzip", strings.Repeat("a", 64) + ".tar.gz"},
+		{"application/vnd.oci.image.layer.v1.tar+gzip", strings.Repeat("a", 64) + ".tar.gz"},
+		{"application/vnd.oci.image.layer.v1.tar+zstd", strings.Repeat("a", 64) + ".tar.zst"},
+		{"application/vnd.oci.image.layer.v1.tar", strings.Repeat("a", 64) + ".tar"},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if name := layerFileName(digest, tt.mediaType); name != tt.name {
+				t.Errorf("want %v, got %v", tt.name, name)
+			}
+		})
+	}
+}
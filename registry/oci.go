@@ -0,0 +1,242 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ipfs "github.com/ipdr/ipdr/ipfs"
+	"github.com/ipdr/ipdr/server/registry/image"
+)
+
+// ErrUnknownSource is error for when the image source of a push is not supported
+var ErrUnknownSource = errors.New("image source must start with \"oci-layout:\", \"oci-archive:\", \"docker-archive:\", \"tarball:\" or \"registry:\"")
+
+// refNameAnnotation is the annotation of an OCI index that holds the tag of a manifest
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// ociIndex is the index.json of an OCI image layout
+// https://github.com/opencontainers/image-spec/blob/master/image-layout.md
+type ociIndex struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	Manifests     []*ociDescriptor `json:"manifests"`
+}
+
+type ociDescriptor struct {
+	image.Descriptor
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociImage is an image read from an OCI image layout
+type ociImage struct {
+	// root manifest, an image manifest or an index of platform manifests
+	manifest []byte
+	digest   string
+	// maps digest -> path of the platform manifests and blobs of the image
+	manifests map[string]string
+	blobs     map[string]string
+}
+
+// PushFrom uploads the image read from source to IPFS. The source is one of
+//
+//	oci-layout:<dir>
+//	oci-archive:<file>
+//	docker-archive:<file>
+//	tarball:<file>
+//	registry:<reference>
+//
+// The image is tagged by the tag of imageID, e.g. name:tag, which also selects
+// the image of a layout that holds several.
+func (r *Registry) PushFrom(source, imageID string) (string, error) {
+	i := strings.Index(source, ":")
+	if i < 0 {
+		return "", ErrUnknownSource
+	}
+	kind, path := source[:i], source[i+1:]
+
+	switch kind {
+	case "oci-layout":
+		return r.PushOCILayout(path, imageID)
+	case "oci-archive":
+		return r.PushOCIArchive(path, imageID)
+	case "tarball":
+		return r.PushTarball(path, imageID)
+	case "registry":
+		return r.PushRemoteImage(path, imageID)
+	case "docker-archive":
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		return r.PushImage(f, imageID)
+	}
+	return "", ErrUnknownSource
+}
+
+// PushOCIArchive uploads the image of a tarred OCI image layout to IPFS
+func (r *Registry) PushOCIArchive(path, imageID string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	tmp, err := mktmp()
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	r.Debugf("[registry] temp: %s", tmp)
+	if err := untar(f, tmp); err != nil {
+		return "", err
+	}
+
+	return r.PushOCILayout(tmp, imageID)
+}
+
+// PushOCILayout uploads the image of an OCI image layout directory to IPFS
+func (r *Registry) PushOCILayout(dir, imageID string) (string, error) {
+	tag := referenceTag(imageID)
+	img, err := readOCILayout(dir, explicitTag(imageID))
+	if err != nil {
+		return "", err
+	}
+
+	r.Debugf("[registry] pushing %s from %s", img.digest, dir)
+	builder := ipfs.NewImageBuilder()
+	for digest, path := range img.manifests {
+		if err := builder.AddManifestFile(digest, path); err != nil {
+			builder.Close()
+			return "", err
+		}
+	}
+	for digest, path := range img.blobs {
+		if err := builder.AddBlobFile(digest, path); err != nil {
+			builder.Close()
+			return "", err
+		}
+	}
+
+	return r.buildImage(builder, tag, img.manifest)
+}
+
+// readOCILayout reads the image of an OCI image layout. If the layout holds several images,
+// the one annotated with tag is taken. Without a tag the one annotated latest is taken,
+// or an index of all images if none is. A layout of a single unannotated image is read for any tag.
+func readOCILayout(dir, tag string) (*ociImage, error) {
+	if _, err := os.Stat(filepath.Join(dir, "oci-layout")); err != nil {
+		return nil, fmt.Errorf("%s is not an OCI image layout: %v", dir, err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var idx ociIndex
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, err
+	}
+	if len(idx.Manifests) == 0 {
+		return nil, errors.New("expected OCI index to contain manifests")
+	}
+
+	want := tag
+	if want == "" {
+		want = "latest"
+	}
+	var descs []*ociDescriptor
+	for _, d := range idx.Manifests {
+		if name := d.Annotations[refNameAnnotation]; name == want || strings.HasSuffix(name, ":"+want) {
+			descs = []*ociDescriptor{d}
+			break
+		}
+	}
+	if descs == nil {
+		unannotated := len(idx.Manifests) == 1 && idx.Manifests[0].Annotations[refNameAnnotation] == ""
+		if tag != "" && !unannotated {
+			return nil, fmt.Errorf("tag %q not found in OCI layout", tag)
+		}
+		descs = idx.Manifests
+	}
+
+	img := &ociImage{
+		manifests: map[string]string{},
+		blobs:     map[string]string{},
+	}
+	if len(descs) == 1 {
+		path, err := blobPath(dir, descs[0].Digest)
+		if err != nil {
+			return nil, err
+		}
+		if img.manifest, err = ioutil.ReadFile(path); err != nil {
+			return nil, err
+		}
+	} else {
+		// several images, publish them as an index
+		index := image.Manifest{
+			SchemaVersion: image.ManifestVersion,
+			MediaType:     image.OCIIndexType,
+		}
+		for _, d := range descs {
+			desc := d.Descriptor
+			index.Manifests = append(index.Manifests, &desc)
+		}
+		if img.manifest, err = json.Marshal(index); err != nil {
+			return nil, err
+		}
+	}
+	img.digest = digestOf(img.manifest)
+
+	if err := img.add(dir, img.manifest); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// add records the platform manifests and blobs referenced by a manifest
+func (img *ociImage) add(dir string, manifest []byte) error {
+	mf, err := image.DecodeManifest(manifest)
+	if err != nil {
+		return err
+	}
+	for _, d := range mf.ManifestDigests() {
+		path, err := blobPath(dir, d)
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		img.manifests[d] = path
+		if err := img.add(dir, b); err != nil {
+			return err
+		}
+	}
+	for _, d := range mf.Digests() {
+		path, err := blobPath(dir, d)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+		img.blobs[d] = path
+	}
+	return nil
+}
+
+// blobPath returns the location of a blob in an OCI image layout, blobs/<alg>/<encoded>
+func blobPath(dir, digest string) (string, error) {
+	ss := strings.SplitN(digest, ":", 2)
+	if len(ss) != 2 || ss[0] == "" || ss[1] == "" || strings.ContainsAny(digest, `/\.`) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(dir, "blobs", ss[0], ss[1]), nil
+}
@@ -0,0 +1,111 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestReadOCILayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	blobs := map[string]string{}
+	write := func(data string) string {
+		digest := digestOf([]byte(data))
+		path := filepath.Join(dir, "blobs", "sha256", digest[len("sha256:"):])
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		blobs[data] = digest
+		return digest
+	}
+
+	config := write(`{"architecture":"amd64","os":"linux"}`)
+	layer := write("layer")
+	amd64 := write(fmt.Sprintf(`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q},"layers":[{"digest":%q}]}`, config, layer))
+	armLayer := write("arm layer")
+	arm := write(fmt.Sprintf(`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q},"layers":[{"digest":%q}]}`, config, armLayer))
+	index := fmt.Sprintf(`{"schemaVersion":2,"manifests":[{"digest":%q,"platform":{"os":"linux","architecture":"amd64"}},{"digest":%q,"platform":{"os":"linux","architecture":"arm"}}]}`, amd64, arm)
+	indexDigest := write(index)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.json"), []byte(fmt.Sprintf(`{"schemaVersion":2,"manifests":[
+		{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"annotations":{"org.opencontainers.image.ref.name":"v1"}},
+		{"mediaType":"application/vnd.oci.image.index.v1+json","digest":%q,"annotations":{"org.opencontainers.image.ref.name":"docker.io/library/app:multi"}}
+	]}`, amd64, indexDigest)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range []struct {
+		tag       string
+		digest    string
+		manifests []string
+		blobs     []string
+	}{
+		{"v1", amd64, nil, []string{config, layer}},
+		{"multi", indexDigest, []string{amd64, arm}, []string{config, layer, armLayer}},
+		// no tag and no latest image, both images are published as an index
+		{"", "", []string{amd64, arm, indexDigest}, []string{config, layer, armLayer}},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			img, err := readOCILayout(dir, tt.tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.digest != "" && img.digest != tt.digest {
+				t.Errorf("want %v, got %v", tt.digest, img.digest)
+			}
+			if img.digest != digestOf(img.manifest) {
+				t.Errorf("want %v, got %v", digestOf(img.manifest), img.digest)
+			}
+			if got := keys(img.manifests); fmt.Sprint(got) != fmt.Sprint(sorted(tt.manifests)) {
+				t.Errorf("want %v, got %v", sorted(tt.manifests), got)
+			}
+			if got := keys(img.blobs); fmt.Sprint(got) != fmt.Sprint(sorted(tt.blobs)) {
+				t.Errorf("want %v, got %v", sorted(tt.blobs), got)
+			}
+		})
+	}
+
+	if _, err := readOCILayout(dir, "latest"); err == nil || err.Error() != `tag "latest" not found in OCI layout` {
+		t.Errorf("want %v, got %v", `tag "latest" not found in OCI layout`, err)
+	}
+
+	// the tag of the reference names the single image of a layout without tags
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.json"), []byte(fmt.Sprintf(`{"schemaVersion":2,"manifests":[{"digest":%q}]}`, amd64)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := readOCILayout(dir, "v2"); err != nil || img.digest != amd64 {
+		t.Errorf("want %v, got %v", amd64, err)
+	}
+
+	if _, err := readOCILayout(filepath.Join(dir, "blobs"), "latest"); err == nil {
+		t.Error("expected error for a directory that is not an OCI image layout")
+	}
+}
+
+func keys(m map[string]string) []string {
+	var ss []string
+	for k := range m {
+		ss = append(ss, k)
+	}
+	return sorted(ss)
+}
+
+func sorted(ss []string) []string {
+	ss = append([]string(nil), ss...)
+	sort.Strings(ss)
+	return ss
+}
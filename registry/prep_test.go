@@ -0,0 +1,89 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIpfsPrepReproducible(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// an extracted `docker save` tarball
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`)
+	configFile := strings.TrimPrefix(digestOf(config), "sha256:") + ".json"
+	if err := ioutil.WriteFile(filepath.Join(tmp, configFile), config, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(tmp, "abc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "abc", "layer.tar"), bytes.Repeat([]byte("layer"), 1000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	manifest, _ := json.Marshal([]*dockerArchiveManifest{{
+		Config:   configFile,
+		RepoTags: []string{"app:v1"},
+		Layers:   []string{"abc/layer.tar"},
+	}})
+	if err := ioutil.WriteFile(filepath.Join(tmp, "manifest.json"), manifest, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// files of the prepared image directory, path -> mode and content
+	snapshot := func(compression string) map[string]string {
+		r := &Registry{compression: compression}
+		workdir, err := r.ipfsPrep(tmp, "app:v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(strings.TrimSuffix(workdir, filepath.FromSlash(repositoryPath("docker.io/library/app"))))
+
+		files := map[string]string{}
+		err = filepath.Walk(workdir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(workdir, path)
+			files[rel] = fmt.Sprintf("%v %x", info.Mode(), b)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+
+	for i, compression := range []string{CompressionGzip, CompressionZstd, CompressionNone} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			a := snapshot(compression)
+			b := snapshot(compression)
+			if fmt.Sprint(a) != fmt.Sprint(b) {
+				t.Errorf("want %v, got %v", a, b)
+			}
+
+			for _, ref := range []string{"latest", "v1"} {
+				data := a[filepath.Join("manifests", ref)]
+				if data == "" {
+					t.Fatalf("expected manifest %s", ref)
+				}
+				if !strings.HasPrefix(data, "-rw-r--r-- ") {
+					t.Errorf("want %v, got %v", "-rw-r--r--", strings.Fields(data)[0])
+				}
+			}
+		})
+	}
+}
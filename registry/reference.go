@@ -0,0 +1,177 @@
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+// defaultImageName is the repository of images pushed without a name, e.g. by image ID
+const defaultImageName = "default"
+
+// shortIDRegexp matches image IDs without the sha256: prefix and their short forms
+var shortIDRegexp = regexp.MustCompile("^" + reference.ShortIdentifierRegexp.String() + "$")
+
+// normalizeImageName returns the fully qualified repository of an image reference,
+// e.g. alpine:3 -> docker.io/library/alpine, localhost:5000/app -> localhost:5000/app
+func normalizeImageName(name string) (string, error) {
+	ref, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return "", err
+	}
+	return ref.Name(), nil
+}
+
+// referenceTag returns the tag of an image reference, e.g. name:tag,
+// or latest for image IDs, sha256:hex, and references without a tag
+func referenceTag(s string) string {
+	if tag := explicitTag(s); tag != "" {
+		return tag
+	}
+	return "latest"
+}
+
+// explicitTag returns the tag of an image reference, or an empty string if it has none
+func explicitTag(s string) string {
+	if strings.HasPrefix(s, "sha256:") {
+		return ""
+	}
+	ref, err := reference.ParseNormalizedNamed(s)
+	if err != nil {
+		return ""
+	}
+	if tagged, ok := ref.(reference.Tagged); ok {
+		return tagged.Tag()
+	}
+	return ""
+}
+
+// archiveImage selects the image of an extracted `docker save` archive to push.
+// It returns the repository of the image and every tag the archive records for it,
+// along with the tag of imageID.
+func archiveImage(tmp string, manifests []*dockerArchiveManifest, imageID string) (string, []string, *dockerArchiveManifest, error) {
+	// legacy repositories file, repository -> tag -> layer ID
+	var repos map[string]map[string]string
+	if _, err := os.Stat(filepath.Join(tmp, "repositories")); err == nil {
+		if repos, err = readJSON(filepath.Join(tmp, "repositories")); err != nil {
+			return "", nil, nil, err
+		}
+	}
+
+	var name string
+	if !strings.HasPrefix(imageID, "sha256:") {
+		// image IDs don't parse as names
+		name, _ = normalizeImageName(imageID)
+	}
+
+	entry := manifests[0]
+	found := false
+	if name != "" {
+	find:
+		for _, m := range manifests {
+			for _, t := range m.RepoTags {
+				if n, err := normalizeImageName(t); err == nil && n == name {
+					entry = m
+					found = true
+					break find
+				}
+			}
+		}
+	}
+	// short image IDs, e.g. a24bb4013296, parse as names too
+	if !found && shortIDRegexp.MatchString(imageID) {
+		name = ""
+	}
+	if name == "" && len(entry.RepoTags) > 0 {
+		name, _ = normalizeImageName(entry.RepoTags[0])
+	}
+	if name == "" {
+		name = defaultImageName
+	}
+
+	seen := map[string]bool{}
+	add := func(tag string) {
+		seen[tag] = true
+	}
+	if imageID != "" {
+		add(referenceTag(imageID))
+	}
+	for _, t := range entry.RepoTags {
+		if n, err := normalizeImageName(t); err == nil && n == name {
+			add(referenceTag(t))
+		}
+	}
+	// the repositories file maps tags to the top layer of their image
+	var top string
+	if len(entry.Layers) > 0 {
+		top = filepath.Dir(entry.Layers[len(entry.Layers)-1])
+	}
+	for repo, tags := range repos {
+		if n, err := normalizeImageName(repo); err != nil || n != name {
+			continue
+		}
+		for tag, id := range tags {
+			if id == top {
+				add(tag)
+			}
+		}
+	}
+
+	var tags []string
+	for tag := range seen {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return name, tags, entry, nil
+}
+
+// archiveTarget is an image of a `docker save` archive and the tags of one of its repositories
+type archiveTarget struct {
+	name  string
+	tags  []string
+	entry *dockerArchiveManifest
+}
+
+// archiveImages returns every image of an archive by repository, for archives that hold
+// several images or tags in several repositories. Images without tags are skipped.
+func archiveImages(manifests []*dockerArchiveManifest) []*archiveTarget {
+	var targets []*archiveTarget
+	for _, m := range manifests {
+		byName := map[string]*archiveTarget{}
+		for _, t := range m.RepoTags {
+			name, err := normalizeImageName(t)
+			if err != nil {
+				continue
+			}
+			target, ok := byName[name]
+			if !ok {
+				target = &archiveTarget{name: name, entry: m}
+				byName[name] = target
+				targets = append(targets, target)
+			}
+			target.tags = append(target.tags, referenceTag(t))
+		}
+	}
+	return targets
+}
+
+// repositoryPath returns the path an image is laid out under in a root holding several images.
+// Images of Docker Hub are laid out under their repository without the registry domain,
+// e.g. docker.io/library/app -> library/app, images of other registries under the domain
+// followed by the repository, so that they do not collide with Docker Hub repositories.
+// Repository paths do not allow colons, the port is separated by an underscore instead,
+// e.g. localhost:5000/library/app -> localhost_5000/library/app
+func repositoryPath(name string) string {
+	ref, err := reference.ParseNormalizedNamed(name)
+	if err != nil || name == defaultImageName {
+		return name
+	}
+	if domain := reference.Domain(ref); domain != "docker.io" {
+		return strings.ToLower(strings.Replace(domain, ":", "_", 1)) + "/" + reference.Path(ref)
+	}
+	return reference.Path(ref)
+}
@@ -0,0 +1,134 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizeImageName(t *testing.T) {
+	for i, tt := range []struct {
+		in   string
+		name string
+		tag  string
+	}{
+		{"alpine", "docker.io/library/alpine", "latest"},
+		{"alpine:3.12", "docker.io/library/alpine", "3.12"},
+		{"example/helloworld", "docker.io/example/helloworld", "latest"},
+		{"localhost:5000/app:1.0", "localhost:5000/app", "1.0"},
+		{"ghcr.io/org/app@sha256:" + fmt.Sprintf("%064d", 0), "ghcr.io/org/app", "latest"},
+		{"sha256:" + fmt.Sprintf("%064d", 0), "", "latest"},
+		{"", "", "latest"},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			name, err := normalizeImageName(tt.in)
+			if tt.name != "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.name != "" && name != tt.name {
+				t.Errorf("want %v, got %v", tt.name, name)
+			}
+			if tag := referenceTag(tt.in); tag != tt.tag {
+				t.Errorf("want %v, got %v", tt.tag, tag)
+			}
+		})
+	}
+}
+
+func TestArchiveImage(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	manifests := []*dockerArchiveManifest{
+		{Config: "a.json", RepoTags: []string{"app:v1", "app:stable", "other/app:v1"}, Layers: []string{"a1/layer.tar", "a2/layer.tar"}},
+		{Config: "b.json", RepoTags: []string{"localhost:5000/app:v2"}, Layers: []string{"b1/layer.tar"}},
+	}
+	repositories := `{"app":{"v1":"a2","stable":"a2","old":"a1","other":"b1"},"localhost:5000/app":{"v2":"b1"}}`
+	if err := ioutil.WriteFile(filepath.Join(tmp, "repositories"), []byte(repositories), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range []struct {
+		imageID string
+		name    string
+		tags    []string
+		config  string
+	}{
+		{"app:v1", "docker.io/library/app", []string{"stable", "v1"}, "a.json"},
+		{"docker.io/library/app", "docker.io/library/app", []string{"latest", "stable", "v1"}, "a.json"},
+		{"localhost:5000/app:v2", "localhost:5000/app", []string{"v2"}, "b.json"},
+		{"sha256:" + fmt.Sprintf("%064d", 0), "docker.io/library/app", []string{"latest", "stable", "v1"}, "a.json"},
+		{"new:v3", "docker.io/library/new", []string{"v3"}, "a.json"},
+		{"a24bb4013296", "docker.io/library/app", []string{"latest", "stable", "v1"}, "a.json"},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			name, tags, entry, err := archiveImage(tmp, manifests, tt.imageID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != tt.name {
+				t.Errorf("want %v, got %v", tt.name, name)
+			}
+			if fmt.Sprint(tags) != fmt.Sprint(tt.tags) {
+				t.Errorf("want %v, got %v", tt.tags, tags)
+			}
+			if entry.Config != tt.config {
+				t.Errorf("want %v, got %v", tt.config, entry.Config)
+			}
+		})
+	}
+
+	name, _, _, err := archiveImage(tmp, []*dockerArchiveManifest{{Config: "c.json"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != defaultImageName {
+		t.Errorf("want %v, got %v", defaultImageName, name)
+	}
+}
+
+func TestArchiveImages(t *testing.T) {
+	manifests := []*dockerArchiveManifest{
+		{Config: "a.json", RepoTags: []string{"app:v1", "app:stable", "ghcr.io/org/app:v1"}},
+		{Config: "b.json", RepoTags: []string{"tool:v2"}},
+		{Config: "c.json"},
+	}
+
+	var got []string
+	for _, target := range archiveImages(manifests) {
+		got = append(got, fmt.Sprintf("%s:%v:%s", repositoryPath(target.name), target.tags, target.entry.Config))
+	}
+	want := []string{
+		"library/app:[v1 stable]:a.json",
+		"ghcr.io/org/app:[v1]:a.json",
+		"library/tool:[v2]:b.json",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+}
+
+func TestRepositoryPath(t *testing.T) {
+	for i, tt := range []struct {
+		name string
+		path string
+	}{
+		{"docker.io/library/app", "library/app"},
+		{"docker.io/org/app", "org/app"},
+		{"ghcr.io/org/app", "ghcr.io/org/app"},
+		{"localhost:5000/library/app", "localhost_5000/library/app"},
+		{defaultImageName, defaultImageName},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if path := repositoryPath(tt.name); path != tt.path {
+				t.Errorf("want %v, got %v", tt.path, path)
+			}
+		})
+	}
+}
@@ -3,7 +3,6 @@ package registry
 import (
 	"archive/tar"
 	"bytes"
-	"compress/gzip"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -21,7 +20,9 @@ import (
 	docker "github.com/ipdr/ipdr/docker"
 	ipfs "github.com/ipdr/ipdr/ipfs"
 	netutil "github.com/ipdr/ipdr/netutil"
+	pinning "github.com/ipdr/ipdr/pinning"
 	server "github.com/ipdr/ipdr/server"
+	"github.com/ipdr/ipdr/server/registry/image"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -30,6 +31,10 @@ type Registry struct {
 	dockerLocalRegistryHost string
 	dockerClient            *docker.Client
 	ipfsClient              *ipfs.Client
+	compression             string
+	compressionLevel        int
+	noPin                   bool
+	pinService              *pinning.Client
 	debug                   bool
 }
 
@@ -38,7 +43,20 @@ type Config struct {
 	DockerLocalRegistryHost string
 	IPFSHost                string
 	IPFSGateway             string
-	Debug                   bool
+	IPFSGateways            []string
+	// Compression is the algorithm uncompressed layers are compressed with, gzip by default
+	Compression string
+	// CompressionLevel is the level of the compression, 0 for the default level
+	CompressionLevel int
+	// NoPin skips pinning pushed images, which garbage collection on the IPFS node may then remove
+	NoPin bool
+	// PinService is the endpoint of an IPFS Pinning Service API to also pin pushed images with
+	PinService string
+	// PinToken is the access token of the pinning service
+	PinToken string
+	// PinTimeout bounds waiting for the pinning service to pin an image
+	PinTimeout time.Duration
+	Debug      bool
 }
 
 // NewRegistry returns a new registry client instance
@@ -61,17 +79,36 @@ func NewRegistry(config *Config) *Registry {
 	}
 
 	ipfsClient := ipfs.NewRemoteClient(&ipfs.Config{
-		Host:       config.IPFSHost,
-		GatewayURL: config.IPFSGateway,
+		Host:        config.IPFSHost,
+		GatewayURL:  config.IPFSGateway,
+		GatewayURLs: config.IPFSGateways,
 	})
 	dockerClient := docker.NewClient(&docker.Config{
 		Debug: config.Debug,
 	})
 
+	compression := config.Compression
+	if compression == "" {
+		compression = CompressionGzip
+	}
+
+	var pinService *pinning.Client
+	if config.PinService != "" {
+		pinService = pinning.NewClient(&pinning.Config{
+			Endpoint: config.PinService,
+			Token:    config.PinToken,
+			Timeout:  config.PinTimeout,
+		})
+	}
+
 	return &Registry{
 		dockerLocalRegistryHost: dockerLocalRegistryHost,
 		ipfsClient:              ipfsClient,
 		dockerClient:            dockerClient,
+		compression:             compression,
+		compressionLevel:        config.CompressionLevel,
+		noPin:                   config.NoPin,
+		pinService:              pinService,
 		debug:                   config.Debug,
 	}
 }
@@ -125,13 +162,24 @@ func (r *Registry) PushImage(reader io.Reader, imageID string) (string, error) {
 		return "", err
 	}
 
-	root, err := r.ipfsPrep(tmp, imageID)
+	// an unnamed archive of several images is pushed under a single root
+	if imageID == "" {
+		manifests, err := readArchiveManifest(tmp + "/manifest.json")
+		if err != nil {
+			return "", err
+		}
+		if targets := archiveImages(manifests); len(targets) > 1 {
+			return r.pushArchiveImages(tmp, targets)
+		}
+	}
+
+	workdir, err := r.ipfsPrep(tmp, imageID)
 	if err != nil {
 		return "", err
 	}
 
-	r.Debugf("[registry] root dir: %s", root)
-	imageIpfsHash, err := r.uploadDir(root)
+	r.Debugf("[registry] image dir: %s", workdir)
+	imageIpfsHash, err := r.uploadImage(workdir)
 	if err != nil {
 		return "", err
 	}
@@ -142,6 +190,80 @@ func (r *Registry) PushImage(reader io.Reader, imageID string) (string, error) {
 	return imageIpfsHash, nil
 }
 
+// PushImagesByID uploads several Docker images, by image ID or repo tag, to IPFS under a single root.
+// Each image is laid out under its repository path, e.g. <cid>/library/app/manifests/<tag>,
+// and blobs shared between the images are only uploaded once.
+func (r *Registry) PushImagesByID(imageIDs []string) (string, error) {
+	if len(imageIDs) == 1 {
+		return r.PushImageByID(imageIDs[0])
+	}
+
+	root, err := mktmp()
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(root)
+
+	for _, imageID := range imageIDs {
+		id, err := r.TagToImageID(imageID)
+		if err != nil {
+			return "", err
+		}
+		reader, err := r.dockerClient.ReadImage(id)
+		if err != nil {
+			return "", err
+		}
+		if err := r.prepArchive(reader, root, imageID); err != nil {
+			return "", err
+		}
+	}
+
+	return r.uploadImages(root)
+}
+
+// prepArchive writes the image of a `docker save` archive to the directory of its repository under root
+func (r *Registry) prepArchive(reader io.Reader, root, imageID string) error {
+	tmp, err := mktmp()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := untar(reader, tmp); err != nil {
+		return err
+	}
+	manifests, err := readArchiveManifest(tmp + "/manifest.json")
+	if err != nil {
+		return err
+	}
+	if len(manifests) == 0 {
+		return errors.New("expected manifest to contain data")
+	}
+	name, tags, manifest, err := archiveImage(tmp, manifests, imageID)
+	if err != nil {
+		return err
+	}
+	_, err = r.prepImage(tmp, root, name, tags, manifest)
+	return err
+}
+
+// pushArchiveImages uploads the images of an extracted archive under a single root
+func (r *Registry) pushArchiveImages(tmp string, targets []*archiveTarget) (string, error) {
+	root, err := mktmp()
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(root)
+
+	for _, t := range targets {
+		if _, err := r.prepImage(tmp, root, t.name, t.tags, t.entry); err != nil {
+			return "", err
+		}
+	}
+
+	return r.uploadImages(root)
+}
+
 // DownloadImage downloads the Docker image from IPFS
 func (r *Registry) DownloadImage(ipfsHash string) (string, error) {
 	tmp, err := mktmp()
@@ -201,9 +323,9 @@ func (r *Registry) runServer() {
 	resp, err := client.Get(url)
 	if err != nil || resp.StatusCode != 200 {
 		srv := server.NewServer(&server.Config{
-			Port:        netutil.ExtractPort(r.dockerLocalRegistryHost),
-			Debug:       r.debug,
-			IPFSGateway: r.ipfsClient.GatewayURL(),
+			Port:         netutil.ExtractPort(r.dockerLocalRegistryHost),
+			Debug:        r.debug,
+			IPFSGateways: r.ipfsClient.GatewayURLs(),
 		})
 		go srv.Start()
 	}
@@ -216,47 +338,40 @@ func (r *Registry) ipfsPrep(tmp string, imageID string) (string, error) {
 		return "", err
 	}
 
-	workdir := root
-	r.Debugf("[registry] preparing image in: %s", workdir)
-	name := "default"
+	manifestJSON, err := readArchiveManifest(tmp + "/manifest.json")
+	if err != nil {
+		return "", err
+	}
 
-	// read human readable name of image
-	if _, err := os.Stat(tmp + "repositories"); err == nil {
-		reposJSON, err := readJSON(tmp + "/repositories")
-		if err != nil {
-			return "", err
-		}
-		if len(reposJSON) != 1 {
-			return "", errors.New("only one repository expected in input file")
-		}
-		for imageName, tags := range reposJSON {
-			r.Debugf("[registry] %s %s", imageName, tags)
-			if len(tags) != 1 {
-				return "", fmt.Errorf("only one tag expected for %s", imageName)
-			}
-			for tag, hash := range tags {
-				name = normalizeImageName(imageName)
-				r.Debugf("[registry] processing image:%s tag:%s hash:256:%s", name, tag, hash)
-			}
-		}
+	if len(manifestJSON) == 0 {
+		return "", errors.New("expected manifest to contain data")
 	}
 
-	workdir = workdir + "/" + name
-	mkdir(workdir)
-	mkdir(workdir + "/manifests")
-	mkdir(workdir + "/blobs")
-	manifestJSON, err := readJSONArray(tmp + "/manifest.json")
+	// read human readable name of image
+	name, tags, manifest, err := archiveImage(tmp, manifestJSON, imageID)
 	if err != nil {
 		return "", err
 	}
 
-	if len(manifestJSON) == 0 {
-		return "", errors.New("expected manifest to contain data")
+	return r.prepImage(tmp, root, name, append(tags, "latest"), manifest)
+}
+
+// prepImage writes the manifest and blobs of an image of an extracted archive
+// to the directory of its repository under root and returns the directory
+func (r *Registry) prepImage(tmp, root, name string, tags []string, manifest *dockerArchiveManifest) (string, error) {
+	r.Debugf("[registry] processing image:%s tags:%s", name, tags)
+
+	workdir := filepath.Join(root, filepath.FromSlash(repositoryPath(name)))
+	r.Debugf("[registry] preparing image in: %s", workdir)
+	if err := os.MkdirAll(workdir+"/manifests", 0755); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(workdir+"/blobs", 0755); err != nil {
+		return "", err
 	}
 
-	manifest := manifestJSON[0]
-	configFile, ok := manifest["Config"].(string)
-	if !ok {
+	configFile := manifest.Config
+	if configFile == "" {
 		return "", errors.New("image archive must be produced by docker > 1.10")
 	}
 
@@ -273,73 +388,118 @@ func (r *Registry) ipfsPrep(tmp string, imageID string) (string, error) {
 		return "", err
 	}
 
-	ref := func(s string) string {
-		//name:tag
-		//sha256:hex
-		if strings.Index(s, "sha256:") != -1 {
-			return "latest"
-		}
-		ss := strings.SplitN(s, ":", 2)
-		if len(ss) == 2 {
-			return ss[1]
-		}
-		return "latest"
+	// the same bytes are stored under every reference so that they match the digest
+	data, err := json.Marshal(mf)
+	if err != nil {
+		return "", err
 	}
-	writeManifest := func() error {
-		tag := ref(imageID)
-		if tag != "latest" {
-			if err = writeJSON(mf, workdir+"/manifests/latest"); err != nil {
-				return err
-			}
+	for _, ref := range append(tags, digestOf(data)) {
+		if err := ioutil.WriteFile(workdir+"/manifests/"+ref, data, 0644); err != nil {
+			return "", err
 		}
-		if err = writeJSON(mf, workdir+"/manifests/"+tag); err != nil {
+	}
+
+	return workdir, nil
+}
+
+// uploadImage streams the manifests and blobs of the image directory to IPFS
+func (r *Registry) uploadImage(workdir string) (string, error) {
+	builder := ipfs.NewImageBuilder()
+	if err := addImageDir(builder, workdir); err != nil {
+		builder.Close()
+		return "", err
+	}
+
+	hash, err := r.build(builder)
+	if err != nil {
+		return "", err
+	}
+
+	r.Debugf("[registry] upload hash %s", hash)
+	return hash, nil
+}
+
+// uploadImages streams the image directories of the repositories under root to IPFS
+func (r *Registry) uploadImages(root string) (string, error) {
+	builder := ipfs.NewImageBuilder()
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || info.Name() != "manifests" {
 			return err
 		}
-		data, err := json.Marshal(mf)
+		workdir := filepath.Dir(path)
+		rel, err := filepath.Rel(root, workdir)
 		if err != nil {
 			return err
 		}
-		rd := sha256.Sum256(data)
-		return writeJSON(mf, workdir+"/manifests/sha256:"+hex.EncodeToString(rd[:]))
-	}
-	if err := writeManifest(); err != nil {
+		r.Debugf("[registry] adding repository %s", filepath.ToSlash(rel))
+		if err := addImageDir(builder.Repository(filepath.ToSlash(rel)), workdir); err != nil {
+			return err
+		}
+		return filepath.SkipDir
+	})
+	if err != nil {
+		builder.Close()
 		return "", err
 	}
 
-	return root, nil
-}
-
-// uploadDir uploads the directory to IPFS
-func (r *Registry) uploadDir(root string) (string, error) {
-	hash, err := r.ipfsClient.AddDir(root)
+	hash, err := r.build(builder)
 	if err != nil {
 		return "", err
 	}
 
 	r.Debugf("[registry] upload hash %s", hash)
+	return hash, nil
+}
 
-	// get the first ref, which contains the image data
-	refs, err := r.ipfsClient.Refs(hash, false)
+// build uploads the image collected by the builder and pins it unless pinning is disabled,
+// and with the pinning service if one is configured
+func (r *Registry) build(builder *ipfs.ImageBuilder) (string, error) {
+	hash, err := r.ipfsClient.BuildImage(builder)
 	if err != nil {
 		return "", err
 	}
-
-	var firstRef string
-	for i := 0; i < 10; i++ {
-		firstRef = <-refs
-
-		if firstRef != "" {
-			return firstRef, nil
+	if !r.noPin {
+		r.Debugf("[registry] pinning %s", hash)
+		if err := r.ipfsClient.Pin(hash); err != nil {
+			return "", err
 		}
 	}
-
-	// return base hash if no refs
-	if firstRef == "" {
-		log.Fatal("NO REF")
-		return hash, nil
+	if r.pinService != nil {
+		r.Debugf("[registry] requesting pin of %s from the pinning service", hash)
+		origins, err := r.ipfsClient.Addresses()
+		if err != nil {
+			r.Debugf("[registry] addresses of the IPFS node: %v", err)
+		}
+		status, err := r.pinService.PinAndWait(hash, "", origins)
+		if err != nil {
+			if status != nil {
+				return "", fmt.Errorf("pin of %s is %s: %v", hash, status.Status, err)
+			}
+			return "", fmt.Errorf("pin of %s: %v", hash, err)
+		}
+		r.Debugf("[registry] pinning service status %s", status.Status)
 	}
+	return hash, nil
+}
 
-	return "", errors.New("could not upload")
+// addImageDir adds the manifests and blobs of an image directory to the builder
+func addImageDir(builder *ipfs.ImageBuilder, workdir string) error {
+	add := func(dir string, fn func(name, path string) error) error {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := fn(e.Name(), filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := add(filepath.Join(workdir, "manifests"), builder.AddManifestFile); err != nil {
+		return err
+	}
+	return add(filepath.Join(workdir, "blobs"), builder.AddBlobFile)
 }
 
 // mktmp creates a temporary directory
@@ -407,7 +567,7 @@ func writeJSON(idate interface{}, path string) error {
 		return err
 	}
 
-	err = ioutil.WriteFile(path, data, os.ModePerm)
+	err = ioutil.WriteFile(path, data, 0644)
 	if err != nil {
 		return err
 	}
@@ -415,104 +575,60 @@ func writeJSON(idate interface{}, path string) error {
 	return nil
 }
 
-// produce v2 manifest of type/application/vnd.docker.distribution.manifest.v2+json
-func (r *Registry) makeV2Manifest(manifest map[string]interface{}, configDigest, configDest, tmp, workdir string) (map[string]interface{}, error) {
+// produce v2 manifest of type/application/vnd.docker.distribution.manifest.v2+json,
+// or an OCI manifest if a layer is compressed with zstd
+func (r *Registry) makeV2Manifest(manifest *dockerArchiveManifest, configDigest, configDest, tmp, workdir string) (*image.Manifest, error) {
 	v2manifest, err := r.prepareV2Manifest(manifest, tmp, workdir+"/blobs")
 	if err != nil {
 		return nil, err
 	}
-	config := make(map[string]interface{})
-	config["digest"] = configDigest
-	config["size"], err = fileSize(configDest)
+	size, err := fileSize(configDest)
 	if err != nil {
 		return nil, err
 	}
-	config["mediaType"] = "application/vnd.docker.container.image.v1+json"
-	conf, ok := v2manifest["config"].(map[string]interface{})
-	if !ok {
-		return nil, errors.New("not ok")
+	v2manifest.Config = &image.Config{
+		MediaType: image.ConfigType,
+		Size:      size,
+		Digest:    configDigest,
 	}
-	v2manifest["config"] = mergemap(conf, config)
-	return v2manifest, nil
-}
-
-// mergemap merges two maps
-func mergemap(a, b map[string]interface{}) map[string]interface{} {
-	for k, v := range b {
-		a[k] = v
+	if v2manifest.MediaType == image.OCIManifestType {
+		v2manifest.Config.MediaType = image.OCIConfigType
 	}
-	return a
+	return v2manifest, nil
 }
 
 // prepareV2Manifest preps the docker image into a docker registry V2 manifest format
-func (r *Registry) prepareV2Manifest(mf map[string]interface{}, tmp, blobDir string) (map[string]interface{}, error) {
-	res := make(map[string]interface{})
-	res["schemaVersion"] = 2
-	res["mediaType"] = "application/vnd.docker.distribution.manifest.v2+json"
-	config := make(map[string]interface{})
-	res["config"] = config
-	var layers []map[string]interface{}
-	mediaType := "application/vnd.docker.image.rootfs.diff.tar.gzip"
-	ls, ok := mf["Layers"].([]interface{})
-	if !ok {
+func (r *Registry) prepareV2Manifest(mf *dockerArchiveManifest, tmp, blobDir string) (*image.Manifest, error) {
+	if len(mf.Layers) == 0 {
 		return nil, errors.New("expected layers")
 	}
-	for _, ifc := range ls {
-		layer, ok := ifc.(string)
-		if !ok {
-			return nil, errors.New("expected string")
-		}
-		obj := make(map[string]interface{})
-		obj["mediaType"] = mediaType
-		size, digest, err := r.compressLayer(tmp+"/"+layer, blobDir)
+	var compressed []*compressedLayer
+	oci := false
+	for _, layer := range mf.Layers {
+		l, err := r.compressLayer(tmp+"/"+layer, blobDir)
 		if err != nil {
 			return nil, err
 		}
-		obj["size"] = size
-		obj["digest"] = "sha256:" + digest
-		layers = append(layers, obj)
+		// zstd layers can only be referenced by OCI manifests
+		oci = oci || l.compression == CompressionZstd
+		compressed = append(compressed, l)
 	}
-	res["layers"] = layers
-	return res, nil
-}
 
-// compressLayer returns the sha256 hash of a directory
-func (r *Registry) compressLayer(path, blobDir string) (int64, string, error) {
-	r.Debugf("[registry] compressing layer: %s", path)
-	tmp := blobDir + "/layer.tmp.tgz"
-
-	err := gzipFile(path, tmp)
-	if err != nil {
-		return int64(0), "", err
-	}
-
-	digest, err := sha256File(tmp)
-	if err != nil {
-		return int64(0), "", err
+	res := &image.Manifest{
+		SchemaVersion: image.ManifestVersion,
+		MediaType:     image.ManifestType,
 	}
-
-	size, err := fileSize(tmp)
-	if err != nil {
-		return int64(0), "", err
+	if oci {
+		res.MediaType = image.OCIManifestType
 	}
-
-	err = renameFile(tmp, fmt.Sprintf("%s/sha256:%s", blobDir, digest))
-	if err != nil {
-		return int64(0), "", err
+	for _, l := range compressed {
+		res.Layers = append(res.Layers, &image.Layer{
+			MediaType: l.mediaType(oci),
+			Size:      l.size,
+			Digest:    l.digest,
+		})
 	}
-
-	return size, digest, nil
-}
-
-// gzipFile gzips a file into a destination file
-func gzipFile(src, dst string) error {
-	data, _ := ioutil.ReadFile(src)
-	var b bytes.Buffer
-	w := gzip.NewWriter(&b)
-	w.Write(data)
-	w.Close()
-
-	return ioutil.WriteFile(dst, b.Bytes(), os.ModePerm)
+	return res, nil
 }
 
 // fileSize returns the size of the file
@@ -525,6 +641,12 @@ func fileSize(path string) (int64, error) {
 	return fi.Size(), nil
 }
 
+// digestOf returns the sha256 digest of data
+func digestOf(data []byte) string {
+	d := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(d[:])
+}
+
 // sha256 returns the sha256 hash of a file
 func sha256File(path string) (string, error) {
 	// TODO: stream instead of reading whole image in memory
@@ -551,13 +673,6 @@ func renameFile(src, dst string) error {
 	return nil
 }
 
-// mkdir creates a directory if it doesn't exist
-func mkdir(path string) {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		os.Mkdir(path, os.ModePerm)
-	}
-}
-
 func copyFile(src, dst string) error {
 	data, err := ioutil.ReadFile(src)
 	if err != nil {
@@ -594,6 +709,9 @@ func untar(reader io.Reader, dst string) error {
 			}
 		// create file
 		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
 			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
 			if err != nil {
 				return err
@@ -620,20 +738,16 @@ func readJSON(filepath string) (map[string]map[string]string, error) {
 	return data, nil
 }
 
-// readJSONArray reads a file into an array of map structures
-func readJSONArray(filepath string) ([]map[string]interface{}, error) {
-	body, _ := ioutil.ReadFile(filepath)
-	var data []map[string]interface{}
-	err := json.Unmarshal(body, &data)
+// readArchiveManifest reads the manifest.json of a `docker save` tarball
+func readArchiveManifest(filepath string) ([]*dockerArchiveManifest, error) {
+	body, err := ioutil.ReadFile(filepath)
 	if err != nil {
-		return data, err
+		return nil, err
+	}
+	var data []*dockerArchiveManifest
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
 	}
 
 	return data, nil
 }
-
-// normalizeImageName normalizes an image name
-func normalizeImageName(name string) string {
-	// TODO
-	return name
-}
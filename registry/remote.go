@@ -0,0 +1,182 @@
+package registry
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	ipfs "github.com/ipdr/ipdr/ipfs"
+)
+
+// PushRemoteImage uploads an image read straight from a remote registry to IPFS,
+// without a Docker daemon. Image indexes are uploaded with all of their platform images.
+// Credentials are taken from the Docker config, e.g. ~/.docker/config.json
+func (r *Registry) PushRemoteImage(reference, imageID string) (string, error) {
+	ref, err := name.ParseReference(reference)
+	if err != nil {
+		return "", err
+	}
+
+	tag := referenceTag(imageID)
+	if t, ok := ref.(name.Tag); ok && imageID == "" {
+		tag = t.TagStr()
+	}
+
+	r.Debugf("[registry] fetching %s", ref)
+	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return "", err
+	}
+
+	builder := ipfs.NewImageBuilder()
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return "", err
+		}
+		err = addImageIndex(builder, idx)
+	} else {
+		var img v1.Image
+		if img, err = desc.Image(); err == nil {
+			err = addImage(builder, img)
+		}
+	}
+	if err != nil {
+		builder.Close()
+		return "", err
+	}
+
+	return r.buildImage(builder, tag, desc.Manifest)
+}
+
+// PushTarball uploads the image of a tarball, as written by `docker save` or
+// go-containerregistry, to IPFS without a Docker daemon. The tarball must hold a single image.
+func (r *Registry) PushTarball(path, imageID string) (string, error) {
+	img, err := tarball.ImageFromPath(path, nil)
+	if err != nil {
+		return "", err
+	}
+
+	manifest, err := img.RawManifest()
+	if err != nil {
+		return "", err
+	}
+
+	builder := ipfs.NewImageBuilder()
+	if err := addImage(builder, img); err != nil {
+		builder.Close()
+		return "", err
+	}
+
+	return r.buildImage(builder, referenceTag(imageID), manifest)
+}
+
+// buildImage adds the root manifest under its tag, latest and its digest, and uploads the image
+func (r *Registry) buildImage(builder *ipfs.ImageBuilder, tag string, manifest []byte) (string, error) {
+	builder.AddManifest(tag, manifest)
+	builder.AddManifest("latest", manifest)
+	builder.AddManifest(digestOf(manifest), manifest)
+
+	hash, err := r.build(builder)
+	if err != nil {
+		return "", err
+	}
+
+	r.Debugf("[registry] upload hash %s", hash)
+	return hash, nil
+}
+
+// addImageIndex adds the manifests and blobs of all images of an index
+func addImageIndex(builder *ipfs.ImageBuilder, idx v1.ImageIndex) error {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+	for _, desc := range im.Manifests {
+		if desc.MediaType.IsIndex() {
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return err
+			}
+			raw, err := child.RawManifest()
+			if err != nil {
+				return err
+			}
+			builder.AddManifest(desc.Digest.String(), raw)
+			if err := addImageIndex(builder, child); err != nil {
+				return err
+			}
+			continue
+		}
+
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			return err
+		}
+		raw, err := img.RawManifest()
+		if err != nil {
+			return err
+		}
+		builder.AddManifest(desc.Digest.String(), raw)
+		if err := addImage(builder, img); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addImage adds the config and layers of an image. Layers are only fetched
+// while the image is being uploaded to IPFS.
+func addImage(builder *ipfs.ImageBuilder, img v1.Image) error {
+	config, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	configDigest, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	builder.AddBlob(configDigest.String(), bytes.NewReader(config))
+
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+		builder.AddBlob(digest.String(), &lazyReader{open: layer.Compressed})
+	}
+	return nil
+}
+
+// lazyReader opens its content on the first read, so that an image with many
+// layers doesn't hold a connection per layer open at once.
+type lazyReader struct {
+	open func() (io.ReadCloser, error)
+	rc   io.ReadCloser
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.rc == nil {
+		rc, err := l.open()
+		if err != nil {
+			return 0, err
+		}
+		l.rc = rc
+	}
+	return l.rc.Read(p)
+}
+
+func (l *lazyReader) Close() error {
+	if l.rc == nil {
+		return nil
+	}
+	return l.rc.Close()
+}
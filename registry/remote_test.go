@@ -0,0 +1,153 @@
+package registry
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcr "github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	ipfs "github.com/ipdr/ipdr/ipfs"
+)
+
+func TestPushFromRemote(t *testing.T) {
+	remoteRegistry := httptest.NewServer(ggcr.New(ggcr.Logger(log.New(ioutil.Discard, "", 0))))
+	defer remoteRegistry.Close()
+	host := strings.TrimPrefix(remoteRegistry.URL, "http://")
+
+	// records the files of the image added to IPFS and the pinned CIDs
+	var added, pinned []string
+	ipfsAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v0/pin/add" {
+			pinned = append(pinned, req.URL.Query().Get("arg"))
+			fmt.Fprint(w, `{"Pins":[]}`)
+			return
+		}
+		added, pinned = nil, nil
+		_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mr := multipart.NewReader(req.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+			filename, _ := url.QueryUnescape(params["filename"])
+			if part.Header.Get("Content-Type") != "application/x-directory" {
+				added = append(added, filename)
+			}
+			io.Copy(ioutil.Discard, part)
+		}
+		fmt.Fprint(w, `{"Hash":"QmImage"}`)
+	}))
+	defer ipfsAPI.Close()
+
+	r := &Registry{
+		ipfsClient: ipfs.NewRemoteClient(&ipfs.Config{
+			Host: strings.TrimPrefix(ipfsAPI.URL, "http://"),
+		}),
+	}
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := random.Index(1024, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgRef, _ := name.ParseReference(host + "/app:1.0")
+	if err := remote.Write(imgRef, img); err != nil {
+		t.Fatal(err)
+	}
+	idxRef, _ := name.ParseReference(host + "/app:multi")
+	if err := remote.WriteIndex(idxRef, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "tarball")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tarPath := filepath.Join(dir, "image.tar")
+	tag, _ := name.NewTag("app:1.0")
+	if err := tarball.WriteToFile(tarPath, tag, img); err != nil {
+		t.Fatal(err)
+	}
+
+	imageFiles := func(img v1.Image) []string {
+		var files []string
+		digest, _ := img.Digest()
+		config, _ := img.ConfigName()
+		files = append(files, "image/manifests/"+digest.String(), "image/blobs/"+config.String())
+		layers, _ := img.Layers()
+		for _, l := range layers {
+			d, _ := l.Digest()
+			files = append(files, "image/blobs/"+d.String())
+		}
+		return files
+	}
+	indexFiles := func(idx v1.ImageIndex) []string {
+		digest, _ := idx.Digest()
+		files := []string{"image/manifests/" + digest.String()}
+		im, _ := idx.IndexManifest()
+		for _, desc := range im.Manifests {
+			child, _ := idx.Image(desc.Digest)
+			files = append(files, imageFiles(child)...)
+		}
+		return files
+	}
+
+	for i, tt := range []struct {
+		source  string
+		imageID string
+		files   []string
+	}{
+		{"registry:" + host + "/app:1.0", "", append(imageFiles(img), "image/manifests/1.0", "image/manifests/latest")},
+		{"registry:" + host + "/app:multi", "app:v2", append(indexFiles(idx), "image/manifests/v2", "image/manifests/latest")},
+		{"tarball:" + tarPath, "app:v3", append(imageFiles(img), "image/manifests/v3", "image/manifests/latest")},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			hash, err := r.PushFrom(tt.source, tt.imageID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hash != "QmImage" {
+				t.Errorf("want %v, got %v", "QmImage", hash)
+			}
+			if fmt.Sprint(sorted(added)) != fmt.Sprint(sorted(tt.files)) {
+				t.Errorf("want %v, got %v", sorted(tt.files), sorted(added))
+			}
+			if fmt.Sprint(pinned) != "[QmImage]" {
+				t.Errorf("want %v, got %v", "[QmImage]", pinned)
+			}
+		})
+	}
+
+	if _, err := r.PushFrom("docker:app", ""); err != ErrUnknownSource {
+		t.Errorf("want %v, got %v", ErrUnknownSource, err)
+	}
+}
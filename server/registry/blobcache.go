@@ -0,0 +1,233 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blobCache is a content addressed cache of blobs pulled from IPFS.
+// Blobs are verified against their digest before they are stored, the least
+// recently used ones are evicted once the cache exceeds its size.
+// Concurrent requests for the same blob share a single fetch.
+//
+// <location>/<digest> holds the blobs, <location>/tmp blobs being fetched.
+// The modification time of a blob records its last access so the order survives restarts.
+type blobCache struct {
+	location string
+	maxSize  int64
+
+	// maps digest -> cached blob
+	entries map[string]*blobCacheEntry
+	// maps digest -> fetch in progress
+	calls map[string]*blobCall
+	size  int64
+	lock  sync.Mutex
+}
+
+type blobCacheEntry struct {
+	size     int64
+	accessed time.Time
+}
+
+type blobCall struct {
+	done chan struct{}
+	err  error
+}
+
+func newBlobCache(location string, maxSize int64) *blobCache {
+	c := &blobCache{
+		location: location,
+		maxSize:  maxSize,
+		entries:  map[string]*blobCacheEntry{},
+		calls:    map[string]*blobCall{},
+	}
+	c.load()
+	return c
+}
+
+// cacheable reports whether blobs with the given digest can be verified and cached.
+func (c *blobCache) cacheable(digest string) bool {
+	return strings.HasPrefix(digest, "sha256:")
+}
+
+func (c *blobCache) path(digest string) string {
+	return filepath.Join(c.location, filepath.Base(digest))
+}
+
+// Stat returns the size of a cached blob.
+func (c *blobCache) Stat(digest string) (int64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[digest]
+	if !ok {
+		return 0, false
+	}
+	return e.size, true
+}
+
+// Open returns the cached blob, fetching it first if it is not cached yet.
+// The caller must close the returned file.
+func (c *blobCache) Open(digest string, fetch func() (io.ReadCloser, error)) (*os.File, error) {
+	// retry once in case a concurrent fill evicted the blob before it was opened
+	for i := 0; i < 2; i++ {
+		if f, ok := c.open(digest); ok {
+			return f, nil
+		}
+		if err := c.fill(digest, fetch); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("blob %q evicted from cache", digest)
+}
+
+func (c *blobCache) open(digest string) (*os.File, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[digest]
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(c.path(digest))
+	if err != nil {
+		c.remove(digest)
+		return nil, false
+	}
+	e.accessed = time.Now()
+	os.Chtimes(c.path(digest), e.accessed, e.accessed)
+	return f, true
+}
+
+// fill fetches a blob into the cache, waiting for a fetch already in progress instead of starting another.
+func (c *blobCache) fill(digest string, fetch func() (io.ReadCloser, error)) error {
+	c.lock.Lock()
+	if _, ok := c.entries[digest]; ok {
+		c.lock.Unlock()
+		return nil
+	}
+	if call, ok := c.calls[digest]; ok {
+		c.lock.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &blobCall{done: make(chan struct{})}
+	c.calls[digest] = call
+	c.lock.Unlock()
+
+	size, err := c.download(digest, fetch)
+
+	c.lock.Lock()
+	if err == nil {
+		c.entries[digest] = &blobCacheEntry{
+			size:     size,
+			accessed: time.Now(),
+		}
+		c.size += size
+		c.evict(digest)
+	}
+	delete(c.calls, digest)
+	c.lock.Unlock()
+
+	call.err = err
+	close(call.done)
+	return err
+}
+
+// download writes the fetched blob to the cache if its content matches digest.
+func (c *blobCache) download(digest string, fetch func() (io.ReadCloser, error)) (int64, error) {
+	tmpDir := filepath.Join(c.location, "tmp")
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(tmpDir, "blob")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	rc, err := fetch()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), rc)
+	if err != nil {
+		return 0, err
+	}
+	if "sha256:"+hex.EncodeToString(h.Sum(nil)) != digest {
+		return 0, errDigestMismatch
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), c.path(digest)); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// evict removes the least recently used blobs until the cache fits, except keep.
+func (c *blobCache) evict(keep string) {
+	if c.maxSize <= 0 || c.size <= c.maxSize {
+		return
+	}
+	digests := make([]string, 0, len(c.entries))
+	for d := range c.entries {
+		digests = append(digests, d)
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return c.entries[digests[i]].accessed.Before(c.entries[digests[j]].accessed)
+	})
+	for _, d := range digests {
+		if c.size <= c.maxSize {
+			break
+		}
+		if d != keep {
+			c.remove(d)
+		}
+	}
+}
+
+func (c *blobCache) remove(digest string) {
+	e, ok := c.entries[digest]
+	if !ok {
+		return
+	}
+	delete(c.entries, digest)
+	c.size -= e.size
+	os.Remove(c.path(digest))
+}
+
+// load indexes the blobs left on disk by a previous run.
+func (c *blobCache) load() {
+	os.RemoveAll(filepath.Join(c.location, "tmp"))
+
+	infos, err := ioutil.ReadDir(c.location)
+	if err != nil {
+		return
+	}
+	for _, fi := range infos {
+		if fi.IsDir() || !c.cacheable(fi.Name()) {
+			continue
+		}
+		c.entries[fi.Name()] = &blobCacheEntry{
+			size:     fi.Size(),
+			accessed: fi.ModTime(),
+		}
+		c.size += fi.Size()
+	}
+	c.evict("")
+}
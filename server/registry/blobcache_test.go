@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBlobCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// sha256 of "hello world"
+	hello := "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	// sha256 of "hello"
+	short := "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	fetches := 0
+	fetch := func(s string) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) {
+			fetches++
+			return ioutil.NopCloser(strings.NewReader(s)), nil
+		}
+	}
+
+	c := newBlobCache(dir, 11)
+	if _, err := c.Open(hello, fetch("tampered")); err != errDigestMismatch {
+		t.Errorf("want %v, got %v", errDigestMismatch, err)
+	}
+	f, err := c.Open(hello, fetch("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// survives a restart without fetching again
+	c = newBlobCache(dir, 11)
+	f, err = c.Open(hello, fetch("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(b) != "hello world" {
+		t.Errorf("want %v, got %s", "hello world", b)
+	}
+	if fetches != 2 {
+		t.Errorf("want %v, got %v", 2, fetches)
+	}
+
+	// least recently used blob is evicted to make room
+	time.Sleep(time.Millisecond)
+	f, err = c.Open(short, fetch("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, ok := c.Stat(hello); ok {
+		t.Error("expected blob to be evicted")
+	}
+	if size, ok := c.Stat(short); !ok || size != 5 {
+		t.Errorf("want %v, got %v", 5, size)
+	}
+}
+
+func TestBlobCacheCoalesce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// sha256 of "hello world"
+	digest := "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+	var lock sync.Mutex
+	fetches := 0
+	release := make(chan struct{})
+	fetch := func() (io.ReadCloser, error) {
+		lock.Lock()
+		fetches++
+		lock.Unlock()
+		<-release
+		return ioutil.NopCloser(strings.NewReader("hello world")), nil
+	}
+
+	c := newBlobCache(dir, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := c.Open(digest, fetch)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			f.Close()
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if fetches != 1 {
+		t.Errorf("want %v, got %v", 1, fetches)
+	}
+}
@@ -15,19 +15,15 @@
 package registry
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"path"
 	"strings"
-	"sync"
+	"time"
 
-	"github.com/ipdr/ipdr/netutil"
+	"github.com/ipdr/ipdr/ipfs"
 )
 
 // Returns whether this url should be handled by the blob handler
@@ -50,12 +46,11 @@ func isBlob(req *http.Request) bool {
 // blobs
 type blobs struct {
 	// Blobs are content addresses. we store them globally underneath their sha and make no distinctions per image.
-	contents map[string][]byte
 	// Each upload gets a unique id that writes occur to until finalized.
-	uploads map[string][]byte
-	lock    sync.Mutex
-
-	layers map[string][]string
+	// Both are staged on disk until the image is added to IPFS.
+	staging *stagingStore
+	// Blobs pulled from IPFS are cached locally if enabled.
+	cache *blobCache
 
 	registry *registry
 }
@@ -77,6 +72,7 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 	target := elem[len(elem)-1]
 	service := elem[len(elem)-2]
 	digest := req.URL.Query().Get("digest")
+	mount := req.URL.Query().Get("mount")
 	contentRange := req.Header.Get("Content-Range")
 	repo := strings.Join(elem[1:len(elem)-2], "/")
 	if service == "uploads" {
@@ -84,12 +80,9 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 	}
 
 	if req.Method == "HEAD" {
-		b.lock.Lock()
-		defer b.lock.Unlock()
-
 		// content is available if image is locally pushed
-		if c, ok := b.contents[target]; ok {
-			resp.Header().Set("Content-Length", fmt.Sprint(len(c)))
+		if size, ok := b.staging.Stat(target); ok {
+			resp.Header().Set("Content-Length", fmt.Sprint(size))
 			resp.Header().Set("Docker-Content-Digest", target)
 			resp.WriteHeader(http.StatusOK)
 			return nil
@@ -104,53 +97,44 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 				Message: err.Error(),
 			}
 		}
-		uri := b.registry.ipfsURL([]string{cid, "blobs", target})
-		ipfsResp, err := http.Head(uri)
-		if err != nil {
-			return &regError{
-				Status:  http.StatusNotFound,
-				Code:    "BLOB_UNKNOWN",
-				Message: err.Error(),
-			}
+
+		// the size is recorded in the manifest, no need to ask IPFS
+		p := ipfsPath([]string{cid, "blobs", target})
+		size, ok := b.registry.manifests.blobSize(target)
+		if !ok && b.cache != nil {
+			size, ok = b.cache.Stat(target)
 		}
-		defer ipfsResp.Body.Close()
-		if ipfsResp.StatusCode != http.StatusOK {
-			return &regError{
-				Status:  http.StatusNotFound,
-				Code:    "BLOB_UNKNOWN",
-				Message: ipfsResp.Status,
+		if !ok {
+			size, err = b.registry.fetcher.Size(p)
+			if err != nil {
+				return &regError{
+					Status:  http.StatusNotFound,
+					Code:    "BLOB_UNKNOWN",
+					Message: err.Error(),
+				}
 			}
 		}
 
-		body, err := ioutil.ReadAll(ipfsResp.Body)
-		size := len(body)
-		if err != nil {
-			return &regError{
-				Status:  http.StatusNotFound,
-				Code:    "BLOB_UNKNOWN",
-				Message: err.Error(),
-			}
+		resp.Header().Set("Accept-Ranges", "bytes")
+		if size >= 0 {
+			resp.Header().Set("Content-Length", fmt.Sprint(size))
 		}
-
-		resp.Header().Set("Content-Length", fmt.Sprint(size))
 		resp.Header().Set("Docker-Content-Digest", target)
-		resp.WriteHeader(ipfsResp.StatusCode)
-		io.CopyN(resp, bytes.NewReader(body), int64(size))
-
+		resp.WriteHeader(http.StatusOK)
 		return nil
 	}
 
 	if req.Method == "GET" {
-		cid, err := b.registry.resolveCID(repo, target)
+		rng, err := parseRange(req.Header.Get("Range"))
 		if err != nil {
 			return &regError{
-				Status:  http.StatusNotFound,
-				Code:    "BLOB_UNKNOWN",
-				Message: err.Error(),
+				Status:  http.StatusRequestedRangeNotSatisfiable,
+				Code:    "RANGE_INVALID",
+				Message: "We don't understand your Range",
 			}
 		}
-		uri := b.registry.ipfsURL([]string{cid, "blobs", target})
-		ipfsResp, err := netutil.Get(uri)
+
+		cid, err := b.registry.resolveCID(repo, target)
 		if err != nil {
 			return &regError{
 				Status:  http.StatusNotFound,
@@ -158,18 +142,80 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 				Message: err.Error(),
 			}
 		}
-		defer ipfsResp.Body.Close()
-		if ipfsResp.StatusCode != http.StatusOK {
-			return &regError{
-				Status:  http.StatusNotFound,
-				Code:    "BLOB_UNKNOWN",
-				Message: ipfsResp.Status,
+		p := ipfsPath([]string{cid, "blobs", target})
+
+		if b.cache != nil && b.cache.cacheable(target) {
+			f, err := b.cache.Open(target, func() (io.ReadCloser, error) {
+				return b.registry.fetcher.Fetch(p, 0, -1)
+			})
+			if err == errDigestMismatch {
+				b.registry.log.Printf("digest mismatch: blob %s at %s", target, p)
+				return &regError{
+					Status:  http.StatusBadGateway,
+					Code:    "DIGEST_INVALID",
+					Message: fmt.Sprintf("content of blob %s does not match its digest", target),
+				}
+			}
+			if err != nil {
+				return &regError{
+					Status:  http.StatusNotFound,
+					Code:    "BLOB_UNKNOWN",
+					Message: err.Error(),
+				}
+			}
+			defer f.Close()
+			resp.Header().Set("Content-Type", "application/octet-stream")
+			resp.Header().Set("Docker-Content-Digest", target)
+			// handles Range requests
+			http.ServeContent(resp, req, "", time.Time{}, f)
+			return nil
+		}
+
+		size, ok := b.registry.manifests.blobSize(target)
+		if !ok {
+			size, err = b.registry.fetcher.Size(p)
+			if err != nil {
+				return &regError{
+					Status:  http.StatusNotFound,
+					Code:    "BLOB_UNKNOWN",
+					Message: err.Error(),
+				}
 			}
 		}
 
-		// TODO ipfsResp.ContentLength could be -1
-		// copy the whole body content - not desirable
-		body, err := ioutil.ReadAll(ipfsResp.Body)
+		// ranges can only be served if the size is known, otherwise the whole blob is sent
+		if rng != nil && size >= 0 {
+			start, end, ok := rng.resolve(size)
+			if !ok {
+				resp.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+				return &regError{
+					Status:  http.StatusRequestedRangeNotSatisfiable,
+					Code:    "RANGE_INVALID",
+					Message: "Your range is not satisfiable",
+				}
+			}
+			body, err := b.registry.fetcher.Fetch(p, start, end)
+			if err != nil {
+				return &regError{
+					Status:  http.StatusNotFound,
+					Code:    "BLOB_UNKNOWN",
+					Message: err.Error(),
+				}
+			}
+			defer body.Close()
+
+			resp.Header().Set("Accept-Ranges", "bytes")
+			resp.Header().Set("Content-Range", formatContentRange(start, end, size))
+			resp.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+			resp.Header().Set("Docker-Content-Digest", target)
+			resp.WriteHeader(http.StatusPartialContent)
+			if _, err := io.CopyN(resp, body, end-start+1); err != nil {
+				b.registry.log.Printf("copying blob %s: %v", target, err)
+			}
+			return nil
+		}
+
+		body, err := b.registry.fetcher.Fetch(p, 0, -1)
 		if err != nil {
 			return &regError{
 				Status:  http.StatusNotFound,
@@ -177,34 +223,58 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 				Message: err.Error(),
 			}
 		}
-		size := len(body)
-		resp.Header().Set("Content-Length", fmt.Sprint(size))
+		defer body.Close()
+
+		resp.Header().Set("Accept-Ranges", "bytes")
+		if size >= 0 {
+			resp.Header().Set("Content-Length", fmt.Sprint(size))
+		}
 		resp.Header().Set("Docker-Content-Digest", target)
-		resp.WriteHeader(ipfsResp.StatusCode)
-		io.CopyN(resp, bytes.NewReader(body), int64(size))
+		resp.WriteHeader(http.StatusOK)
 
+		_, err = io.Copy(resp, newDigestVerifier(body, target))
+		if err == errDigestMismatch {
+			// the status is already sent, abort the response so the client does not accept the blob
+			b.registry.log.Printf("digest mismatch: blob %s at %s", target, p)
+			panic(http.ErrAbortHandler)
+		}
+		if err != nil {
+			b.registry.log.Printf("copying blob %s: %v", target, err)
+		}
 		return nil
 	}
 
+	// https://github.com/opencontainers/distribution-spec/blob/master/spec.md#mounting-a-blob-from-another-repository
+	if req.Method == "POST" && target == "uploads" && mount != "" {
+		if b.mount(repo, mount, req.URL.Query().Get("from")) {
+			resp.Header().Set("Location", "/"+path.Join("v2", repo, "blobs", mount))
+			resp.Header().Set("Docker-Content-Digest", mount)
+			resp.WriteHeader(http.StatusCreated)
+			return nil
+		}
+		// not mountable, fall back to a regular upload
+	}
+
 	if req.Method == "POST" && target == "uploads" && digest != "" {
-		l := &bytes.Buffer{}
-		io.Copy(l, req.Body)
-		rd := sha256.Sum256(l.Bytes())
-		d := "sha256:" + hex.EncodeToString(rd[:])
-		if d != digest {
+		id := fmt.Sprint(rand.Int63())
+		if _, err := b.staging.Append(id, req.Body); err != nil {
+			b.staging.Cancel(id)
+			return &regError{
+				Status:  http.StatusInternalServerError,
+				Code:    "BLOB_UPLOAD_INVALID",
+				Message: err.Error(),
+			}
+		}
+		if err := b.staging.Commit(id, digest); err != nil {
+			b.staging.Cancel(id)
 			return &regError{
 				Status:  http.StatusBadRequest,
 				Code:    "DIGEST_INVALID",
-				Message: "digest does not match contents",
+				Message: err.Error(),
 			}
 		}
 
-		b.lock.Lock()
-		defer b.lock.Unlock()
-		b.contents[d] = l.Bytes()
-		digests := b.layers[repo]
-		b.layers[repo] = append(digests, d)
-		resp.Header().Set("Docker-Content-Digest", d)
+		resp.Header().Set("Docker-Content-Digest", digest)
 		resp.WriteHeader(http.StatusCreated)
 		return nil
 	}
@@ -218,7 +288,7 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 	}
 
 	if req.Method == "PATCH" && service == "uploads" && contentRange != "" {
-		start, end := 0, 0
+		var start, end int64
 		if _, err := fmt.Sscanf(contentRange, "%d-%d", &start, &end); err != nil {
 			return &regError{
 				Status:  http.StatusRequestedRangeNotSatisfiable,
@@ -226,28 +296,30 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 				Message: "We don't understand your Content-Range",
 			}
 		}
-		b.lock.Lock()
-		defer b.lock.Unlock()
-		if start != len(b.uploads[target]) {
+		size, _ := b.staging.UploadSize(target)
+		if start != size {
 			return &regError{
 				Status:  http.StatusRequestedRangeNotSatisfiable,
 				Code:    "BLOB_UPLOAD_UNKNOWN",
 				Message: "Your content range doesn't match what we have",
 			}
 		}
-		l := bytes.NewBuffer(b.uploads[target])
-		io.Copy(l, req.Body)
-		b.uploads[target] = l.Bytes()
+		size, err := b.staging.Append(target, req.Body)
+		if err != nil {
+			return &regError{
+				Status:  http.StatusInternalServerError,
+				Code:    "BLOB_UPLOAD_INVALID",
+				Message: err.Error(),
+			}
+		}
 		resp.Header().Set("Location", "/"+path.Join("v2", path.Join(elem[1:len(elem)-3]...), "blobs/uploads", target))
-		resp.Header().Set("Range", fmt.Sprintf("0-%d", len(l.Bytes())-1))
+		resp.Header().Set("Range", fmt.Sprintf("0-%d", size-1))
 		resp.WriteHeader(http.StatusNoContent)
 		return nil
 	}
 
 	if req.Method == "PATCH" && service == "uploads" && contentRange == "" {
-		b.lock.Lock()
-		defer b.lock.Unlock()
-		if _, ok := b.uploads[target]; ok {
+		if _, ok := b.staging.UploadSize(target); ok {
 			return &regError{
 				Status:  http.StatusBadRequest,
 				Code:    "BLOB_UPLOAD_INVALID",
@@ -255,12 +327,16 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 			}
 		}
 
-		l := &bytes.Buffer{}
-		io.Copy(l, req.Body)
-
-		b.uploads[target] = l.Bytes()
+		size, err := b.staging.Append(target, req.Body)
+		if err != nil {
+			return &regError{
+				Status:  http.StatusInternalServerError,
+				Code:    "BLOB_UPLOAD_INVALID",
+				Message: err.Error(),
+			}
+		}
 		resp.Header().Set("Location", "/"+path.Join("v2", path.Join(elem[1:len(elem)-3]...), "blobs/uploads", target))
-		resp.Header().Set("Range", fmt.Sprintf("0-%d", len(l.Bytes())-1))
+		resp.Header().Set("Range", fmt.Sprintf("0-%d", size-1))
 		resp.WriteHeader(http.StatusNoContent)
 		return nil
 	}
@@ -274,25 +350,22 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 	}
 
 	if req.Method == "PUT" && service == "uploads" && digest != "" {
-		b.lock.Lock()
-		defer b.lock.Unlock()
-		l := bytes.NewBuffer(b.uploads[target])
-		io.Copy(l, req.Body)
-		rd := sha256.Sum256(l.Bytes())
-		d := "sha256:" + hex.EncodeToString(rd[:])
-		if d != digest {
+		if _, err := b.staging.Append(target, req.Body); err != nil {
+			return &regError{
+				Status:  http.StatusInternalServerError,
+				Code:    "BLOB_UPLOAD_INVALID",
+				Message: err.Error(),
+			}
+		}
+		if err := b.staging.Commit(target, digest); err != nil {
 			return &regError{
 				Status:  http.StatusBadRequest,
 				Code:    "DIGEST_INVALID",
-				Message: "digest does not match contents",
+				Message: err.Error(),
 			}
 		}
 
-		b.contents[d] = l.Bytes()
-		digests := b.layers[repo]
-		b.layers[repo] = append(digests, d)
-		delete(b.uploads, target)
-		resp.Header().Set("Docker-Content-Digest", d)
+		resp.Header().Set("Docker-Content-Digest", digest)
 		resp.WriteHeader(http.StatusCreated)
 		return nil
 	}
@@ -304,39 +377,69 @@ func (b *blobs) handle(resp http.ResponseWriter, req *http.Request) *regError {
 	}
 }
 
-func (b *blobs) get(repo string) (map[string][]byte, bool) {
-	b.lock.Lock()
-
-	digests, ok := b.layers[repo]
+// mount makes a blob of the from repo available to repo without transferring it again.
+func (b *blobs) mount(repo, digest, from string) bool {
+	if _, ok := b.staging.Stat(digest); ok {
+		return true
+	}
+	if from == "" {
+		return false
+	}
+	// only the images of from, other images that contain the blob may not be readable to the client
+	cid, ok := b.registry.cids.Get(from, digest)
 	if !ok {
-		return nil, false
+		cid = contentRoot(from)
 	}
+	if cid == "" {
+		return false
+	}
+	// make sure the blob is part of the source image
+	if _, err := b.registry.ipfsClient.ResolvePath(fmt.Sprintf("/ipfs/%s/blobs/%s", cid, digest)); err != nil {
+		b.registry.log.Printf("mounting %s from %s: %v", digest, from, err)
+		return false
+	}
+	b.registry.cids.Add(repo, digest, cid)
+	return true
+}
 
-	layers := make(map[string][]byte)
+// addTo adds the given blobs of repo to the image builder. Blobs that are known to be part
+// of a published image are linked from it, others are streamed from the staging area.
+func (b *blobs) addTo(builder *ipfs.ImageBuilder, repo string, digests []string) error {
 	for _, d := range digests {
-		blob, ok := b.contents[d]
-		if !ok {
-			return nil, false
+		if blob, ok := b.published(repo, d); ok {
+			builder.LinkBlob(d, blob)
+			continue
+		}
+		if _, ok := b.staging.Stat(d); !ok {
+			return fmt.Errorf("blob %q not found", d)
+		}
+		if err := builder.AddBlobFile(d, b.staging.BlobPath(d)); err != nil {
+			return err
 		}
-		layers[d] = blob
 	}
-
-	b.lock.Unlock()
-	return layers, true
+	return nil
 }
 
-func (b *blobs) remove(repo string) {
-	b.lock.Lock()
-
-	digests, ok := b.layers[repo]
+// published returns the cid of a blob that is already stored on IPFS as part of another image.
+func (b *blobs) published(repo, digest string) (string, bool) {
+	cid, ok := b.registry.cids.Get(repo, digest)
+	if !ok {
+		cid, ok = b.registry.cids.Lookup(digest)
+	}
 	if !ok {
-		return
+		return "", false
 	}
-	delete(b.layers, repo)
+	blob, err := b.registry.ipfsClient.ResolvePath(fmt.Sprintf("/ipfs/%s/blobs/%s", cid, digest))
+	if err != nil {
+		b.registry.log.Printf("resolving blob %s in %s: %v", digest, cid, err)
+		return "", false
+	}
+	return blob, true
+}
 
+// remove discards the staged blobs once they are stored on IPFS.
+func (b *blobs) remove(digests []string) {
 	for _, d := range digests {
-		delete(b.contents, d)
+		b.staging.Remove(d)
 	}
-
-	b.lock.Unlock()
 }
@@ -0,0 +1,232 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ipdr/ipdr/server/registry/image"
+)
+
+// imageNode is a stand-in IPFS node for pushed images. Directories map paths to file CIDs.
+type imageNode struct {
+	files map[string][]byte
+	dirs  map[string]map[string]string
+	// uploads counts how often each file CID was added
+	uploads map[string]int
+}
+
+func newImageNode() *imageNode {
+	return &imageNode{
+		files:   map[string][]byte{},
+		dirs:    map[string]map[string]string{},
+		uploads: map[string]int{},
+	}
+}
+
+func (n *imageNode) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	args := req.URL.Query()["arg"]
+	enc := json.NewEncoder(w)
+	switch req.URL.Path {
+	case "/api/v0/add":
+		dir := map[string]string{}
+		for name, b := range multipartFiles(req) {
+			cid := "bafk" + computeDigest(b)[7:23]
+			n.files[cid] = b
+			n.uploads[cid]++
+			dir[strings.TrimPrefix(name, "image/")] = cid
+			enc.Encode(map[string]string{"Name": name, "Hash": cid})
+		}
+		enc.Encode(map[string]string{"Name": "image", "Hash": n.addDir(dir)})
+	case "/api/v0/object/patch/add-link":
+		dir := map[string]string{}
+		for p, cid := range n.dirs[args[0]] {
+			dir[p] = cid
+		}
+		dir[args[1]] = args[2]
+		enc.Encode(map[string]string{"Hash": n.addDir(dir)})
+	case "/api/v0/resolve", "/api/v0/cat":
+		ss := strings.SplitN(strings.TrimPrefix(args[0], "/ipfs/"), "/", 2)
+		cid, ok := n.dirs[ss[0]][ss[len(ss)-1]]
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(map[string]interface{}{"Message": "no link named " + args[0], "Code": 0, "Type": "error"})
+			return
+		}
+		if req.URL.Path == "/api/v0/resolve" {
+			enc.Encode(map[string]string{"Path": "/ipfs/" + cid})
+			return
+		}
+		b := n.files[cid]
+		offset, _ := strconv.Atoi(req.URL.Query().Get("offset"))
+		b = b[offset:]
+		if l, err := strconv.Atoi(req.URL.Query().Get("length")); err == nil && l < len(b) {
+			b = b[:l]
+		}
+		w.Write(b)
+	case "/api/v0/pin/add":
+		enc.Encode(map[string][]string{"Pins": args})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (n *imageNode) addDir(dir map[string]string) string {
+	cid := fmt.Sprintf("bafydir%d", len(n.dirs))
+	n.dirs[cid] = dir
+	return cid
+}
+
+// createTestRegistry returns a registry on the IPFS API with staging and the CID store in dir
+func createTestRegistry(api *httptest.Server, dir string) http.Handler {
+	return New(&Config{
+		IPFSHost:       strings.TrimPrefix(api.URL, "http://"),
+		CIDStorePath:   dir + "/cids",
+		StagingPath:    dir + "/staging",
+		ContentFetcher: FetchAPI,
+	}, Logger(log.New(ioutil.Discard, "", 0)))
+}
+
+// request sends a request to the registry and returns the response
+func request(h http.Handler, method, target, contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// pushBlob uploads the content to the repo in a single request and returns its digest
+func pushBlob(h http.Handler, repo, content string) string {
+	digest := computeDigest([]byte(content))
+	request(h, http.MethodPost, "/v2/"+repo+"/blobs/uploads/?digest="+digest, "", content)
+	return digest
+}
+
+// imageManifest returns an image manifest of the config and layers
+func imageManifest(config string, layers ...string) string {
+	descriptor := func(mediaType, content string) map[string]interface{} {
+		return map[string]interface{}{"mediaType": mediaType, "digest": computeDigest([]byte(content)), "size": len(content)}
+	}
+	var l []map[string]interface{}
+	for _, layer := range layers {
+		l = append(l, descriptor(image.LayerType, layer))
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     image.ManifestType,
+		"config":        descriptor(image.ConfigType, config),
+		"layers":        l,
+	})
+	return string(b)
+}
+
+func TestLinkPublishedBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newImageNode()
+	api := httptest.NewServer(node)
+	defer api.Close()
+	r := createTestRegistry(api, dir)
+
+	layer := pushBlob(r, "app", "shared layer")
+	pushBlob(r, "app", "config 1")
+	rec := request(r, http.MethodPut, "/v2/app/manifests/v1", image.ManifestType, imageManifest("config 1", "shared layer"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("want %v, got %v: %s", http.StatusCreated, rec.Code, rec.Body)
+	}
+	first := rec.Header().Get("X-Docker-Content-ID")
+
+	// the layer is not uploaded again, the second image links it from the first
+	pushBlob(r, "tool", "config 2")
+	rec = request(r, http.MethodPut, "/v2/tool/manifests/v1", image.ManifestType, imageManifest("config 2", "shared layer"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("want %v, got %v: %s", http.StatusCreated, rec.Code, rec.Body)
+	}
+	second := rec.Header().Get("X-Docker-Content-ID")
+
+	cid := node.dirs[first]["blobs/"+layer]
+	if got := node.dirs[second]["blobs/"+layer]; got != cid {
+		t.Errorf("want %v, got %v", cid, got)
+	}
+	if node.uploads[cid] != 1 {
+		t.Errorf("want %v, got %v", 1, node.uploads[cid])
+	}
+
+	rec = request(r, http.MethodGet, "/v2/tool/blobs/"+layer, "", "")
+	if rec.Body.String() != "shared layer" {
+		t.Errorf("want %v, got %v", "shared layer", rec.Body)
+	}
+}
+
+func TestMountBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newImageNode()
+	api := httptest.NewServer(node)
+	defer api.Close()
+	r := createTestRegistry(api, dir)
+
+	layer := pushBlob(r, "app", "layer")
+	pushBlob(r, "app", "config")
+	if rec := request(r, http.MethodPut, "/v2/app/manifests/v1", image.ManifestType, imageManifest("config", "layer")); rec.Code != http.StatusCreated {
+		t.Fatalf("want %v, got %v: %s", http.StatusCreated, rec.Code, rec.Body)
+	}
+	missing := computeDigest([]byte("missing"))
+
+	for i, tt := range []struct {
+		digest   string
+		from     string
+		status   int
+		location string
+	}{
+		{layer, "app", http.StatusCreated, "/v2/tool/blobs/" + layer},
+		// not mountable, falls back to an upload
+		{layer, "unknown", http.StatusAccepted, "/v2/tool/blobs/uploads/"},
+		{missing, "app", http.StatusAccepted, "/v2/tool/blobs/uploads/"},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			rec := request(r, http.MethodPost, "/v2/tool/blobs/uploads/?mount="+tt.digest+"&from="+tt.from, "", "")
+			if rec.Code != tt.status {
+				t.Fatalf("want %v, got %v: %s", tt.status, rec.Code, rec.Body)
+			}
+			if location := rec.Header().Get("Location"); !strings.HasPrefix(location, tt.location) {
+				t.Errorf("want %v, got %v", tt.location, location)
+			}
+			if tt.status != http.StatusCreated {
+				return
+			}
+			if digest := rec.Header().Get("Docker-Content-Digest"); digest != tt.digest {
+				t.Errorf("want %v, got %v", tt.digest, digest)
+			}
+		})
+	}
+
+	// the mounted blob is linked into images of the repo it is mounted to
+	pushBlob(r, "tool", "tool config")
+	rec := request(r, http.MethodPut, "/v2/tool/manifests/v1", image.ManifestType, imageManifest("tool config", "layer"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("want %v, got %v: %s", http.StatusCreated, rec.Code, rec.Body)
+	}
+	if _, ok := node.dirs[rec.Header().Get("X-Docker-Content-ID")]["blobs/"+layer]; !ok {
+		t.Errorf("blob %s missing from the image", layer)
+	}
+}
@@ -0,0 +1,100 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errRangeInvalid = errors.New("invalid range")
+
+// byteRange is a single range of a Range header with an inclusive end.
+// A negative start denotes the last -start bytes, a negative end an open ended range.
+// https://tools.ietf.org/html/rfc7233#section-2.1
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// parseRange parses the value of a Range header. Only a single range is supported,
+// nil is returned for an empty header or multiple ranges so that the whole content is served.
+func parseRange(s string) (*byteRange, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(s, "bytes=") {
+		return nil, errRangeInvalid
+	}
+	s = strings.TrimSpace(strings.TrimPrefix(s, "bytes="))
+	if strings.Contains(s, ",") {
+		return nil, nil
+	}
+	i := strings.Index(s, "-")
+	if i < 0 {
+		return nil, errRangeInvalid
+	}
+	first, last := strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+
+	// suffix range: bytes=-500
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, errRangeInvalid
+		}
+		return &byteRange{start: -n, end: -1}, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return nil, errRangeInvalid
+	}
+	if last == "" {
+		return &byteRange{start: start, end: -1}, nil
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return nil, errRangeInvalid
+	}
+	return &byteRange{start: start, end: end}, nil
+}
+
+// String formats the range as a Range header value.
+func (r *byteRange) String() string {
+	if r.start < 0 {
+		return fmt.Sprintf("bytes=%d", r.start)
+	}
+	if r.end < 0 {
+		return fmt.Sprintf("bytes=%d-", r.start)
+	}
+	return fmt.Sprintf("bytes=%d-%d", r.start, r.end)
+}
+
+// resolve returns the absolute inclusive offsets of the range within content of the given size.
+// It reports false if the range cannot be satisfied.
+func (r *byteRange) resolve(size int64) (int64, int64, bool) {
+	if size <= 0 {
+		return 0, 0, false
+	}
+	start, end := r.start, r.end
+	if start < 0 {
+		start = size + start
+		if start < 0 {
+			start = 0
+		}
+		return start, size - 1, true
+	}
+	if start >= size {
+		return 0, 0, false
+	}
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+	return start, end, true
+}
+
+// formatContentRange formats the Content-Range header value for the given offsets and total size.
+func formatContentRange(start, end, size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", start, end, size)
+}
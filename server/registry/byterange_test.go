@@ -0,0 +1,57 @@
+package registry
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	for i, tt := range []struct {
+		in    string
+		out   *byteRange
+		isErr bool
+	}{
+		{"", nil, false},
+		{"bytes=0-99", &byteRange{0, 99}, false},
+		{"bytes=100-", &byteRange{100, -1}, false},
+		{"bytes=-500", &byteRange{-500, -1}, false},
+		{"bytes=0-1,5-6", nil, false},
+		{"bytes=5-1", nil, true},
+		{"bytes=-0", nil, true},
+		{"items=0-1", nil, true},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got, err := parseRange(tt.in)
+			if (err != nil) != tt.isErr {
+				t.Fatalf("want error %v, got %v", tt.isErr, err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.out) {
+				t.Errorf("want %v, got %v", tt.out, got)
+			}
+		})
+	}
+}
+
+func TestResolveRange(t *testing.T) {
+	for i, tt := range []struct {
+		in    byteRange
+		size  int64
+		start int64
+		end   int64
+		ok    bool
+	}{
+		{byteRange{0, 99}, 1000, 0, 99, true},
+		{byteRange{100, -1}, 1000, 100, 999, true},
+		{byteRange{900, 2000}, 1000, 900, 999, true},
+		{byteRange{-100, -1}, 1000, 900, 999, true},
+		{byteRange{-2000, -1}, 1000, 0, 999, true},
+		{byteRange{1000, -1}, 1000, 0, 0, false},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			start, end, ok := tt.in.resolve(tt.size)
+			if start != tt.start || end != tt.end || ok != tt.ok {
+				t.Errorf("want %v %v %v, got %v %v %v", tt.start, tt.end, tt.ok, start, end, ok)
+			}
+		})
+	}
+}
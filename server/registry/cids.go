@@ -11,12 +11,23 @@ import (
 // cidStore contains known cid entries.
 type cidStore struct {
 	// maps repo:tag -> cid
-	cids     map[string]string
+	cids map[string]string
+	// maps digest -> cid of a published image that contains it
+	digests map[string]string
+	// maps repo:tag -> pinned cid
+	pins map[string]string
+	// entries are kept in memory only if empty
 	location string
 
 	sync.RWMutex
 }
 
+// digestsDir holds the digest entries apart from the repo:tag entries.
+const digestsDir = ".digests"
+
+// pinsDir holds the repo:tag entries that are pinned, mapped to the pinned cid.
+const pinsDir = ".pins"
+
 func key(repo, ref string) string {
 	return repo + ":" + ref
 }
@@ -33,9 +44,31 @@ func (r *cidStore) Add(repo, reference string, cid string) {
 		r.writeCID(k, cid)
 	}
 
+	// content is immutable, any image containing the digest will do
+	if strings.HasPrefix(reference, "sha256:") && r.digests[reference] != cid {
+		r.digests[reference] = cid
+		r.writeCID(key(digestsDir, reference), cid)
+	}
+
 	r.Unlock()
 }
 
+// Lookup returns the cid of a published image that contains the digest regardless of the repo.
+func (r *cidStore) Lookup(digest string) (string, bool) {
+	r.RLock()
+
+	val, ok := r.digests[digest]
+	if !ok {
+		if v, err := r.readCID(key(digestsDir, digest)); err == nil {
+			val = v
+			ok = true
+		}
+	}
+
+	r.RUnlock()
+	return val, ok
+}
+
 func (r *cidStore) Get(repo, reference string) (string, bool) {
 	r.RLock()
 
@@ -53,10 +86,75 @@ func (r *cidStore) Get(repo, reference string) (string, bool) {
 	return val, ok
 }
 
-func (r *cidStore) readCID(key string) (string, error) {
+// AddPin records that the cid is pinned for repo:reference.
+func (r *cidStore) AddPin(repo, reference string, cid string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.pins[key(repo, reference)] = cid
+	return r.writeCID(key(pinsDir+"/"+repo, reference), cid)
+}
+
+// RemovePin removes the pin record of repo:reference.
+func (r *cidStore) RemovePin(repo, reference string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.pins, key(repo, reference))
+	if r.location == "" {
+		return nil
+	}
+	return os.Remove(r.path(key(pinsDir+"/"+repo, reference)))
+}
+
+// Pins returns the pinned repo:reference entries mapped to their cid.
+func (r *cidStore) Pins() (map[string]string, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	pins := map[string]string{}
+	if r.location == "" {
+		for k, cid := range r.pins {
+			pins[k] = cid
+		}
+		return pins, nil
+	}
+	dir := filepath.Join(r.location, pinsDir)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == dir {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if i := strings.LastIndex(rel, "/"); i > 0 {
+			pins[key(rel[:i], rel[i+1:])] = string(content)
+		}
+		return nil
+	})
+	return pins, err
+}
+
+// path returns the file of the repo:reference key.
+func (r *cidStore) path(key string) string {
 	pc := strings.SplitN(key, ":", 2)
-	p := filepath.Join(r.location, strings.Join(pc, "/"))
-	content, err := ioutil.ReadFile(p)
+	return filepath.Join(r.location, strings.Join(pc, "/"))
+}
+
+func (r *cidStore) readCID(key string) (string, error) {
+	if r.location == "" {
+		return "", os.ErrNotExist
+	}
+	content, err := ioutil.ReadFile(r.path(key))
 	if err != nil {
 		return "", err
 	}
@@ -64,8 +162,10 @@ func (r *cidStore) readCID(key string) (string, error) {
 }
 
 func (r *cidStore) writeCID(key string, val string) error {
-	pc := strings.SplitN(key, ":", 2)
-	p := filepath.Join(r.location, strings.Join(pc, "/"))
+	if r.location == "" {
+		return nil
+	}
+	p := r.path(key)
 	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
 		return err
 	}
@@ -77,6 +177,8 @@ func newCIDStore(location string) *cidStore {
 
 	return &cidStore{
 		cids:     map[string]string{},
+		digests:  map[string]string{},
+		pins:     map[string]string{},
 		location: location,
 	}
 }
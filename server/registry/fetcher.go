@@ -0,0 +1,155 @@
+package registry
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/ipdr/ipdr/ipfs"
+)
+
+// Content fetchers selectable by Config.ContentFetcher
+const (
+	// FetchGateway reads content from the IPFS gateway
+	FetchGateway = "gateway"
+	// FetchAPI reads content with cat over the IPFS HTTP API
+	FetchAPI = "api"
+	// FetchFallback reads content from the gateway and falls back to the API
+	FetchFallback = "fallback"
+)
+
+// fetcher retrieves content stored on IPFS by path, e.g. /ipfs/<cid>/blobs/<digest>.
+type fetcher interface {
+	// Fetch returns the content between the inclusive offsets start and end,
+	// a negative end reads to the end of the content.
+	Fetch(path string, start, end int64) (io.ReadCloser, error)
+	// Size returns the size of the content, -1 if it is unknown.
+	Size(path string) (int64, error)
+}
+
+func newFetcher(kind string, client *ipfs.Client) (fetcher, error) {
+	switch kind {
+	case "", FetchGateway:
+		return &gatewayFetcher{gateways: client.Gateways()}, nil
+	case FetchAPI:
+		return &apiFetcher{client: client}, nil
+	case FetchFallback:
+		return &fallbackFetcher{
+			fetchers: []fetcher{
+				&gatewayFetcher{gateways: client.Gateways()},
+				&apiFetcher{client: client},
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown content fetcher %q", kind)
+}
+
+// gatewayFetcher reads content from read-only IPFS gateways
+type gatewayFetcher struct {
+	gateways *ipfs.GatewayPool
+}
+
+func (f *gatewayFetcher) Fetch(path string, start, end int64) (io.ReadCloser, error) {
+	ranged := start > 0 || end >= 0
+	resp, err := f.gateways.Do(func(gateway string) (*http.Request, error) {
+		req, err := http.NewRequest("GET", gateway+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if ranged {
+			req.Header.Set("Range", (&byteRange{start: start, end: end}).String())
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && ranged:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK:
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+
+	// gateway ignored the range, skip to the requested offset ourselves
+	if _, err := io.CopyN(ioutil.Discard, resp.Body, start); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if end < 0 {
+		return resp.Body, nil
+	}
+	return &readCloser{
+		Reader: io.LimitReader(resp.Body, end-start+1),
+		Closer: resp.Body,
+	}, nil
+}
+
+func (f *gatewayFetcher) Size(path string) (int64, error) {
+	resp, err := f.gateways.Do(func(gateway string) (*http.Request, error) {
+		return http.NewRequest("HEAD", gateway+path, nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return resp.ContentLength, nil
+}
+
+// apiFetcher reads content with cat over the IPFS HTTP API
+type apiFetcher struct {
+	client *ipfs.Client
+}
+
+func (f *apiFetcher) Fetch(path string, start, end int64) (io.ReadCloser, error) {
+	length := int64(-1)
+	if end >= 0 {
+		length = end - start + 1
+	}
+	return f.client.CatRange(path, start, length)
+}
+
+func (f *apiFetcher) Size(path string) (int64, error) {
+	return f.client.FileSize(path)
+}
+
+// fallbackFetcher tries each fetcher in turn until one succeeds
+type fallbackFetcher struct {
+	fetchers []fetcher
+}
+
+func (f *fallbackFetcher) Fetch(path string, start, end int64) (io.ReadCloser, error) {
+	var err error
+	for _, ft := range f.fetchers {
+		var rc io.ReadCloser
+		rc, err = ft.Fetch(path, start, end)
+		if err == nil {
+			return rc, nil
+		}
+	}
+	return nil, err
+}
+
+func (f *fallbackFetcher) Size(path string) (int64, error) {
+	var err error
+	for _, ft := range f.fetchers {
+		var size int64
+		size, err = ft.Size(path)
+		if err == nil {
+			return size, nil
+		}
+	}
+	return 0, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
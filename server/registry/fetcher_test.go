@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipdr/ipdr/ipfs"
+)
+
+func TestGatewayFetcher(t *testing.T) {
+	content := "hello world"
+	ranges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	defer ranges.Close()
+	noRanges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, content)
+	}))
+	defer noRanges.Close()
+
+	for i, tt := range []struct {
+		start int64
+		end   int64
+		want  string
+	}{
+		{0, -1, "hello world"},
+		{6, -1, "world"},
+		{0, 4, "hello"},
+		{4, 6, "o w"},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			for _, gw := range []string{ranges.URL, noRanges.URL} {
+				f := &gatewayFetcher{gateways: ipfs.NewGatewayPool(&ipfs.GatewayPoolConfig{URLs: []string{gw}})}
+				rc, err := f.Fetch("/ipfs/cid", tt.start, tt.end)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := ioutil.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(b) != tt.want {
+					t.Errorf("want %v, got %s", tt.want, b)
+				}
+			}
+		})
+	}
+
+	f := &gatewayFetcher{gateways: ipfs.NewGatewayPool(&ipfs.GatewayPoolConfig{URLs: []string{ranges.URL}})}
+	size, err := f.Size("/ipfs/cid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(content)) {
+		t.Errorf("want %v, got %v", len(content), size)
+	}
+}
@@ -24,6 +24,27 @@ const ManifestType = "application/vnd.docker.distribution.manifest.v2+json"
 const ConfigType = "application/vnd.docker.container.image.v1+json"
 const LayerType = "application/vnd.docker.image.rootfs.diff.tar.gzip"
 
+// UncompressedLayerType is the media type of an uncompressed Docker layer
+const UncompressedLayerType = "application/vnd.docker.image.rootfs.diff.tar"
+
+// ManifestListType is the media type of a Docker manifest list
+const ManifestListType = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+// OCI media types
+// https://github.com/opencontainers/image-spec/blob/master/media-types.md
+const OCIManifestType = "application/vnd.oci.image.manifest.v1+json"
+const OCIIndexType = "application/vnd.oci.image.index.v1+json"
+const OCIConfigType = "application/vnd.oci.image.config.v1+json"
+const OCILayerType = "application/vnd.oci.image.layer.v1.tar+gzip"
+const OCIZstdLayerType = "application/vnd.oci.image.layer.v1.tar+zstd"
+const OCIUncompressedLayerType = "application/vnd.oci.image.layer.v1.tar"
+
+// DefaultPlatform is the platform served to clients that do not accept manifest lists
+var DefaultPlatform = Platform{
+	OS:           "linux",
+	Architecture: "amd64",
+}
+
 type Config struct {
 	MediaType string `json:"mediaType"`
 	Size      int64  `json:"size"`
@@ -34,17 +55,80 @@ type Layer struct {
 	Size      int64  `json:"size"`
 	Digest    string `json:"digest"`
 }
+
+// Platform describes the platform an image of an index or manifest list runs on
+type Platform struct {
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+}
+
+// Descriptor references a manifest of an index or manifest list
+type Descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Size      int64     `json:"size"`
+	Digest    string    `json:"digest"`
+	Platform  *Platform `json:"platform,omitempty"`
+}
+
+// Manifest is a Docker image manifest, OCI image manifest, Docker manifest list or OCI index.
+// Image manifests reference a config and layers, indexes and lists reference manifests.
 type Manifest struct {
-	SchemaVersion int      `json:"schemaVersion"`
-	MediaType     string   `json:"mediaType"`
-	Config        *Config  `json:"config"`
-	Layers        []*Layer `json:"layers"`
+	SchemaVersion int           `json:"schemaVersion"`
+	MediaType     string        `json:"mediaType"`
+	Config        *Config       `json:"config,omitempty"`
+	Layers        []*Layer      `json:"layers,omitempty"`
+	Manifests     []*Descriptor `json:"manifests,omitempty"`
+}
+
+// IsIndex reports whether the manifest is an OCI index or a Docker manifest list
+func (r *Manifest) IsIndex() bool {
+	return r != nil && (r.MediaType == OCIIndexType || r.MediaType == ManifestListType)
 }
 
+// Digests returns the digests of the config and layers of an image manifest
 func (r *Manifest) Digests() []string {
-	digests := []string{r.Config.Digest}
+	if r == nil {
+		return nil
+	}
+	var digests []string
+	if r.Config != nil {
+		digests = append(digests, r.Config.Digest)
+	}
 	for _, l := range r.Layers {
 		digests = append(digests, l.Digest)
 	}
 	return digests
 }
+
+// ManifestDigests returns the digests of the manifests of an index or manifest list
+func (r *Manifest) ManifestDigests() []string {
+	if r == nil {
+		return nil
+	}
+	var digests []string
+	for _, m := range r.Manifests {
+		digests = append(digests, m.Digest)
+	}
+	return digests
+}
+
+// Match returns the manifest of an index or manifest list for the platform.
+// The variant is only compared if requested.
+func (r *Manifest) Match(p Platform) *Descriptor {
+	if r == nil {
+		return nil
+	}
+	for _, m := range r.Manifests {
+		if m.Platform == nil {
+			continue
+		}
+		if m.Platform.OS == p.OS && m.Platform.Architecture == p.Architecture &&
+			(p.Variant == "" || m.Platform.Variant == p.Variant) {
+			return m
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package image
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeManifest(t *testing.T) {
+	for i, tt := range []struct {
+		in        string
+		mediaType string
+		index     bool
+		digests   []string
+		manifests []string
+	}{
+		{
+			`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"mediaType":"application/vnd.docker.container.image.v1+json","digest":"sha256:c"},"layers":[{"digest":"sha256:l"}]}`,
+			ManifestType, false, []string{"sha256:c", "sha256:l"}, nil,
+		},
+		{
+			`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:c"},"layers":[{"digest":"sha256:l"}]}`,
+			OCIManifestType, false, []string{"sha256:c", "sha256:l"}, nil,
+		},
+		{
+			`{"schemaVersion":2,"manifests":[{"digest":"sha256:a","platform":{"os":"linux","architecture":"amd64"}}]}`,
+			OCIIndexType, true, nil, []string{"sha256:a"},
+		},
+		{
+			`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.list.v2+json","manifests":[{"digest":"sha256:a"},{"digest":"sha256:b"}]}`,
+			ManifestListType, true, nil, []string{"sha256:a", "sha256:b"},
+		},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			m, err := DecodeManifest([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.MediaType != tt.mediaType {
+				t.Errorf("want %v, got %v", tt.mediaType, m.MediaType)
+			}
+			if m.IsIndex() != tt.index {
+				t.Errorf("want %v, got %v", tt.index, m.IsIndex())
+			}
+			if !reflect.DeepEqual(m.Digests(), tt.digests) {
+				t.Errorf("want %v, got %v", tt.digests, m.Digests())
+			}
+			if !reflect.DeepEqual(m.ManifestDigests(), tt.manifests) {
+				t.Errorf("want %v, got %v", tt.manifests, m.ManifestDigests())
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	m, err := DecodeManifest([]byte(`{"schemaVersion":2,"manifests":[
+		{"digest":"sha256:arm","platform":{"os":"linux","architecture":"arm","variant":"v7"}},
+		{"digest":"sha256:amd64","platform":{"os":"linux","architecture":"amd64"}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tt := range []struct {
+		platform Platform
+		want     string
+	}{
+		{DefaultPlatform, "sha256:amd64"},
+		{Platform{OS: "linux", Architecture: "arm"}, "sha256:arm"},
+		{Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, ""},
+		{Platform{OS: "windows", Architecture: "amd64"}, ""},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			var got string
+			if d := m.Match(tt.platform); d != nil {
+				got = d.Digest
+			}
+			if got != tt.want {
+				t.Errorf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	for i, tt := range []struct {
+		accept    []string
+		mediaType string
+		want      bool
+	}{
+		{nil, OCIIndexType, true},
+		{[]string{ManifestType}, ManifestType, true},
+		{[]string{ManifestType}, ManifestListType, false},
+		{[]string{ManifestType, ManifestListType}, ManifestListType, true},
+		{[]string{ManifestType + ", " + OCIIndexType}, OCIIndexType, true},
+		{[]string{"application/*"}, OCIManifestType, true},
+		{[]string{"*/*"}, OCIManifestType, true},
+		{[]string{ManifestType, OCIIndexType + ";q=0"}, OCIIndexType, false},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if got := Accepts(tt.accept, tt.mediaType); got != tt.want {
+				t.Errorf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -2,12 +2,56 @@ package image
 
 import (
 	"encoding/json"
+	"mime"
+	"strconv"
+	"strings"
 )
 
+// DecodeManifest decodes an image manifest, index or manifest list.
+// The media type is inferred from the content if it is not set, as it is optional for OCI manifests.
 func DecodeManifest(b []byte) (*Manifest, error) {
 	var m Manifest
 	if err := json.Unmarshal(b, &m); err != nil {
 		return nil, err
 	}
+	if m.MediaType == "" {
+		m.MediaType = mediaType(&m)
+	}
 	return &m, nil
 }
+
+func mediaType(m *Manifest) string {
+	switch {
+	case m.Manifests != nil:
+		return OCIIndexType
+	case m.Config != nil && m.Config.MediaType == ConfigType:
+		return ManifestType
+	case m.Config != nil:
+		return OCIManifestType
+	}
+	return ""
+}
+
+// Accepts reports whether a media type is acceptable for the values of Accept headers.
+// Everything is acceptable if no media types are listed.
+// https://tools.ietf.org/html/rfc7231#section-5.3.2
+func Accepts(accept []string, mediaType string) bool {
+	listed := false
+	for _, h := range accept {
+		for _, v := range strings.Split(h, ",") {
+			t, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+			if err != nil {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+			listed = true
+			if t == mediaType || t == "*/*" ||
+				(strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+				return true
+			}
+		}
+	}
+	return !listed
+}
@@ -0,0 +1,67 @@
+package registry
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/ipdr/ipdr/ipfs"
+)
+
+// registryIndex is a directory of repo/tag files holding the cid of the tag in the MFS of the
+// IPFS node, the layout read by the IPFS and IPNS resolvers. Every push updates the directory,
+// so its root CID can be exported to the resolvers of other servers, e.g. with DNSLink,
+// or republished under an IPNS key.
+type registryIndex struct {
+	client *ipfs.Client
+	path   string
+	key    string
+	log    *log.Logger
+
+	// publishing serializes publishing under the key, so that a later root is never
+	// replaced by an earlier one
+	publishing sync.Mutex
+}
+
+func newRegistryIndex(client *ipfs.Client, indexPath, key string, l *log.Logger) *registryIndex {
+	return &registryIndex{
+		client: client,
+		path:   "/" + strings.Trim(indexPath, "/"),
+		key:    key,
+		log:    l,
+	}
+}
+
+// Add writes repo:reference -> cid to the index and returns the new root CID of the index
+func (x *registryIndex) Add(repo, reference, cid string) (string, error) {
+	for _, e := range strings.Split(repo+"/"+reference, "/") {
+		if e == "" || e == "." || e == ".." {
+			return "", fmt.Errorf("invalid index entry: %s:%s", repo, reference)
+		}
+	}
+	if err := x.client.WriteFile(path.Join(x.path, repo, reference), []byte(cid)); err != nil {
+		return "", err
+	}
+	return x.client.FileHash(x.path)
+}
+
+// Publish republishes the latest root of the index under the key and logs the outcome.
+// It is meant to run in the background, publishing on IPNS may take a minute.
+func (x *registryIndex) Publish() {
+	x.publishing.Lock()
+	defer x.publishing.Unlock()
+
+	root, err := x.client.FileHash(x.path)
+	if err != nil {
+		x.log.Printf("registry index: %v", err)
+		return
+	}
+	name, err := x.client.Publish(x.key, "/ipfs/"+root)
+	if err != nil {
+		x.log.Printf("registry index: publish of %s: %v", root, err)
+		return
+	}
+	x.log.Printf("registry index: published %s under /ipns/%s", root, name)
+}
@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipdr/ipdr/ipfs"
+)
+
+func TestRegistryIndex(t *testing.T) {
+	// the MFS of the IPFS node, path -> content, and the published path
+	mfs := map[string]string{}
+	var published string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		arg := req.URL.Query().Get("arg")
+		switch req.URL.Path {
+		case "/api/v0/files/write":
+			for _, b := range multipartFiles(req) {
+				mfs[arg] = string(b)
+			}
+		case "/api/v0/files/stat":
+			json.NewEncoder(w).Encode(map[string]string{"Hash": fmt.Sprintf("root%d", len(mfs))})
+		case "/api/v0/name/publish":
+			published = arg
+			json.NewEncoder(w).Encode(map[string]string{"Name": "k51self", "Value": arg})
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer api.Close()
+
+	client := ipfs.NewRemoteClient(&ipfs.Config{Host: strings.TrimPrefix(api.URL, "http://")})
+	x := newRegistryIndex(client, "ipdr/index/", "self", log.New(ioutil.Discard, "", 0))
+
+	for i, tt := range []struct {
+		repo      string
+		reference string
+		cid       string
+		root      string
+	}{
+		{"app", "v1", "bafyapp1", "root1"},
+		{"library/tool", "latest", "bafytool", "root2"},
+		{"app", "v1", "bafyapp2", "root2"},
+		{"app/../etc", "v1", "bafyapp3", ""},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			root, err := x.Add(tt.repo, tt.reference, tt.cid)
+			if tt.root == "" {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if root != tt.root {
+				t.Errorf("want %v, got %v", tt.root, root)
+			}
+			p := "/ipdr/index/" + tt.repo + "/" + tt.reference
+			if mfs[p] != tt.cid {
+				t.Errorf("want %v, got %v", tt.cid, mfs[p])
+			}
+		})
+	}
+
+	x.Publish()
+	if published != "/ipfs/root2" {
+		t.Errorf("want %v, got %v", "/ipfs/root2", published)
+	}
+}
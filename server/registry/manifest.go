@@ -24,8 +24,7 @@ import (
 	"strings"
 	"sync"
 
-	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/ipdr/ipdr/ipfs"
 	"github.com/ipdr/ipdr/server/registry/image"
 )
 
@@ -36,9 +35,8 @@ type manifest struct {
 }
 
 type manifests struct {
-	// maps repo -> manifest tag/digest -> manifest
-	manifests map[string]map[string]*manifest
-	lock      sync.Mutex
+	cache *manifestCache
+	lock  sync.Mutex
 
 	registry *registry
 }
@@ -60,11 +58,18 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 	target := elem[len(elem)-1]
 	repo := strings.Join(elem[1:len(elem)-2], "/")
 
-	if req.Method == "GET" {
+	if req.Method == "GET" || req.Method == "HEAD" {
 		m.lock.Lock()
 		defer m.lock.Unlock()
 
 		mf, err := m.fetch(repo, target)
+		if err == errDigestMismatch {
+			return &regError{
+				Status:  http.StatusBadGateway,
+				Code:    "DIGEST_INVALID",
+				Message: fmt.Sprintf("content of manifest %s does not match its digest", target),
+			}
+		}
 		if err != nil {
 			return &regError{
 				Status:  http.StatusNotFound,
@@ -82,26 +87,9 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 				Message: err.Error(),
 			}
 		}
-		f, _ := image.DecodeManifest(mf.blob)
-
-		for _, d := range f.Digests() {
-			m.registry.cids.Add(repo, d, cid)
-		}
-
-		resp.Header().Set("Docker-Content-Digest", mf.digest)
-		resp.Header().Set("X-Docker-Content-ID", cid)
-		resp.Header().Set("Content-Type", mf.contentType)
-		resp.Header().Set("Content-Length", fmt.Sprint(len(mf.blob)))
-		resp.WriteHeader(http.StatusOK)
-		io.Copy(resp, bytes.NewReader(mf.blob))
-		return nil
-	}
-
-	if req.Method == "HEAD" {
-		m.lock.Lock()
-		defer m.lock.Unlock()
+		m.register(repo, cid, mf)
 
-		mf, err := m.fetch(repo, target)
+		mf, err = m.negotiate(repo, target, mf, req.Header["Accept"])
 		if err != nil {
 			return &regError{
 				Status:  http.StatusNotFound,
@@ -111,9 +99,13 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 		}
 
 		resp.Header().Set("Docker-Content-Digest", mf.digest)
+		resp.Header().Set("X-Docker-Content-ID", cid)
 		resp.Header().Set("Content-Type", mf.contentType)
 		resp.Header().Set("Content-Length", fmt.Sprint(len(mf.blob)))
 		resp.WriteHeader(http.StatusOK)
+		if req.Method == "GET" {
+			io.Copy(resp, bytes.NewReader(mf.blob))
+		}
 		return nil
 	}
 
@@ -121,9 +113,6 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 		m.lock.Lock()
 		defer m.lock.Unlock()
 
-		if _, ok := m.manifests[repo]; !ok {
-			m.manifests[repo] = map[string]*manifest{}
-		}
 		b := &bytes.Buffer{}
 		io.Copy(b, req.Body)
 
@@ -131,57 +120,71 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 		mf := manifest{
 			blob:        b.Bytes(),
 			contentType: req.Header.Get("Content-Type"),
+			digest:      digest,
+		}
+
+		f, err := image.DecodeManifest(mf.blob)
+		if err != nil {
+			return &regError{
+				Status:  http.StatusBadRequest,
+				Code:    "MANIFEST_INVALID",
+				Message: err.Error(),
+			}
+		}
+		if mf.contentType == "" {
+			mf.contentType = f.MediaType
 		}
 
 		// If the manifest is a manifest list, check that the manifest
 		// list's constituent manifests are already uploaded.
 		// This isn't strictly required by the registry API, but some
 		// registries require this.
-		if mf.contentType == string(types.OCIImageIndex) ||
-			mf.contentType == string(types.DockerManifestList) {
-
-			im, err := v1.ParseIndexManifest(b)
+		// The image then contains all platform manifests and their blobs.
+		digests := f.Digests()
+		children := map[string]*manifest{}
+		for _, d := range f.ManifestDigests() {
+			child, err := m.fetch(repo, d)
 			if err != nil {
 				return &regError{
 					Status:  http.StatusNotFound,
 					Code:    "MANIFEST_UNKNOWN",
-					Message: err.Error(),
+					Message: fmt.Sprintf("Sub-manifest %q not found", d),
 				}
 			}
-			for _, desc := range im.Manifests {
-				if _, found := m.manifests[repo][desc.Digest.String()]; !found {
-					return &regError{
-						Status:  http.StatusNotFound,
-						Code:    "MANIFEST_UNKNOWN",
-						Message: fmt.Sprintf("Sub-manifest %q not found", desc.Digest),
-					}
+			children[d] = child
+			cf, err := image.DecodeManifest(child.blob)
+			if err != nil {
+				return &regError{
+					Status:  http.StatusBadRequest,
+					Code:    "MANIFEST_INVALID",
+					Message: fmt.Sprintf("Sub-manifest %q: %v", d, err),
 				}
 			}
+			digests = append(digests, cf.Digests()...)
 		}
+		digests = uniq(digests)
 
 		// Allow future references by target (tag) and immutable digest.
 		// See https://docs.docker.com/engine/reference/commandline/pull/#pull-an-image-by-digest-immutable-identifier.
-		m.manifests[repo][target] = &mf
-		m.manifests[repo][digest] = &mf
-
-		layers, ok := m.registry.blobs.get(repo)
-		if !ok {
+		m.cache.Put(repo, target, &mf)
+
+		builder := ipfs.NewImageBuilder()
+		builder.AddManifest(target, mf.blob)
+		builder.AddManifest(digest, mf.blob)
+		builder.AddManifest("latest", mf.blob) // <cid>/latest
+		for d, child := range children {
+			builder.AddManifest(d, child.blob)
+		}
+		if err := m.registry.blobs.addTo(builder, repo, digests); err != nil {
+			builder.Close()
 			return &regError{
 				Status:  http.StatusNotFound,
 				Code:    "MANIFEST_BLOB_UNKNOWN",
-				Message: fmt.Sprintf("layers for %q not found", repo),
+				Message: err.Error(),
 			}
 		}
 
-		// TODO cache e.g. move to disk?
-		m.registry.blobs.remove(repo)
-
-		refs := make(map[string][]byte)
-		refs[target] = mf.blob
-		refs[digest] = mf.blob
-		refs["latest"] = mf.blob // <cid>/latest
-
-		cid, err := m.registry.ipfsClient.AddImage(refs, layers)
+		cid, err := m.registry.ipfsClient.BuildImage(builder)
 		if err != nil {
 			return &regError{
 				Status:  http.StatusInternalServerError,
@@ -189,11 +192,50 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 				Message: err.Error(),
 			}
 		}
+		m.registry.blobs.remove(digests)
+
+		// manifests pushed by digest, e.g. the platform manifests of an index, are
+		// pinned as part of the image of the tag that refers to them
+		if !strings.HasPrefix(target, "sha256:") {
+			if !m.registry.config.NoPin {
+				if err := m.registry.pins.pin(repo, target, cid); err != nil {
+					return &regError{
+						Status:  http.StatusInternalServerError,
+						Code:    "",
+						Message: err.Error(),
+					}
+				}
+			}
+			if m.registry.pinService != nil {
+				go m.registry.remotePin(repo, target, cid)
+			}
+		}
 
 		m.registry.cids.Add(repo, target, cid)
 		m.registry.cids.Add(repo, digest, cid)
 		m.registry.cids.Add(cid, "latest", cid) // <cid>/latest
 
+		// platform manifests and blobs can now be pulled or mounted from the new image
+		for d := range children {
+			m.registry.cids.Add(repo, d, cid)
+		}
+		for _, d := range digests {
+			m.registry.cids.Add(repo, d, cid)
+		}
+
+		// other servers learn about the tag from the resolvers of the registry index
+		if m.registry.index != nil && !strings.HasPrefix(target, "sha256:") {
+			root, err := m.registry.index.Add(repo, target, cid)
+			if err != nil {
+				m.registry.log.Printf("registry index: %v", err)
+			} else {
+				resp.Header().Set("X-Registry-Index", root)
+				if m.registry.index.key != "" {
+					go m.registry.index.Publish()
+				}
+			}
+		}
+
 		resp.Header().Set("Docker-Content-Digest", digest)
 		resp.Header().Set("X-Docker-Content-ID", cid)
 		resp.WriteHeader(http.StatusCreated)
@@ -206,11 +248,16 @@ func (m *manifests) handle(resp http.ResponseWriter, req *http.Request) *regErro
 	}
 }
 
+// get returns the manifest of repo by tag or digest from the cache or IPFS.
+func (m *manifests) get(repo, target string) (*manifest, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.fetch(repo, target)
+}
+
 func (m *manifests) fetch(repo, target string) (*manifest, error) {
-	if _, ok := m.manifests[repo]; !ok {
-		m.manifests[repo] = map[string]*manifest{}
-	}
-	mf, ok := m.manifests[repo][target]
+	mf, ok := m.cache.Get(repo, target)
 	if ok {
 		return mf, nil
 	}
@@ -225,8 +272,7 @@ func (m *manifests) fetch(repo, target string) (*manifest, error) {
 		return nil, err
 	}
 
-	m.manifests[repo][target] = mf
-	m.manifests[repo][mf.digest] = mf
+	m.cache.Put(repo, target, mf)
 
 	// conform to the distribution registry specification
 	// in case target is tag, we need to resolve also by hash.
@@ -235,6 +281,47 @@ func (m *manifests) fetch(repo, target string) (*manifest, error) {
 	return mf, nil
 }
 
+// register records the image cid for the blobs and manifests referenced by a manifest,
+// so that they can be pulled by digest.
+func (m *manifests) register(repo, cid string, mf *manifest) {
+	f, err := image.DecodeManifest(mf.blob)
+	if err != nil {
+		return
+	}
+	for _, d := range f.Digests() {
+		m.registry.cids.Add(repo, d, cid)
+	}
+	for _, d := range f.ManifestDigests() {
+		m.registry.cids.Add(repo, d, cid)
+	}
+}
+
+// negotiate returns the manifest to serve for the values of Accept headers. Clients that do not
+// accept an index or manifest list are served the image manifest of the default platform when
+// pulling by tag; a pull by digest is always served the manifest of that digest.
+func (m *manifests) negotiate(repo, target string, mf *manifest, accept []string) (*manifest, error) {
+	if image.Accepts(accept, mf.contentType) {
+		return mf, nil
+	}
+	if strings.HasPrefix(target, "sha256:") {
+		return nil, fmt.Errorf("manifest %s of type %s is not acceptable", target, mf.contentType)
+	}
+	f, err := image.DecodeManifest(mf.blob)
+	if err != nil || !f.IsIndex() {
+		return mf, nil
+	}
+	d := f.Match(image.DefaultPlatform)
+	if d == nil {
+		return nil, fmt.Errorf("no manifest for platform %s/%s", image.DefaultPlatform.OS, image.DefaultPlatform.Architecture)
+	}
+	return m.fetch(repo, d.Digest)
+}
+
+// blobSize returns the size of a blob as recorded by a known manifest.
+func (m *manifests) blobSize(digest string) (int64, bool) {
+	return m.cache.BlobSize(digest)
+}
+
 func computeDigest(b []byte) string {
 	rd := sha256.Sum256(b)
 	d := "sha256:" + hex.EncodeToString(rd[:])
@@ -242,15 +329,19 @@ func computeDigest(b []byte) string {
 }
 
 func (m *manifests) getManifest(cid, target string) (*manifest, error) {
-	b, err := getContent(m.registry.config.IPFSGateway, cid, []string{"manifests", target})
+	b, err := getContent(m.registry.fetcher, cid, []string{"manifests", target})
 	if err != nil {
 		return nil, err
 	}
+	digest := computeDigest(b)
+	if strings.HasPrefix(target, "sha256:") && digest != target {
+		m.registry.log.Printf("digest mismatch: manifest %s of %s has digest %s", target, cid, digest)
+		return nil, errDigestMismatch
+	}
 	mf, err := image.DecodeManifest(b)
 	if err != nil {
 		return nil, err
 	}
-	digest := computeDigest(b)
 	return &manifest{
 		blob:        b,
 		contentType: mf.MediaType,
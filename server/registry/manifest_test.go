@@ -0,0 +1,154 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ipdr/ipdr/server/registry/image"
+)
+
+// imageIndex returns a manifest list of the image manifests by platform architecture
+func imageIndex(manifests map[string]string) string {
+	var descriptors []map[string]interface{}
+	for _, arch := range []string{"amd64", "arm64"} {
+		mf, ok := manifests[arch]
+		if !ok {
+			continue
+		}
+		descriptors = append(descriptors, map[string]interface{}{
+			"mediaType": image.ManifestType,
+			"digest":    computeDigest([]byte(mf)),
+			"size":      len(mf),
+			"platform":  image.Platform{OS: "linux", Architecture: arch},
+		})
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     image.ManifestListType,
+		"manifests":     descriptors,
+	})
+	return string(b)
+}
+
+func TestPushIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newImageNode()
+	api := httptest.NewServer(node)
+	defer api.Close()
+	r := createTestRegistry(api, dir)
+
+	manifests := map[string]string{}
+	for _, arch := range []string{"amd64", "arm64"} {
+		for _, content := range []string{"config " + arch, "shared layer", "layer " + arch} {
+			pushBlob(r, "app", content)
+		}
+		mf := imageManifest("config "+arch, "shared layer", "layer "+arch)
+		rec := request(r, http.MethodPut, "/v2/app/manifests/"+computeDigest([]byte(mf)), image.ManifestType, mf)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("want %v, got %v: %s", http.StatusCreated, rec.Code, rec.Body)
+		}
+		manifests[arch] = mf
+	}
+	rec := request(r, http.MethodPut, "/v2/app/manifests/v1", image.ManifestListType, imageIndex(manifests))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("want %v, got %v: %s", http.StatusCreated, rec.Code, rec.Body)
+	}
+	cid := rec.Header().Get("X-Docker-Content-ID")
+
+	// platform manifests and every blob of both platforms end up in the image of the index
+	for _, content := range []string{"config amd64", "layer amd64", "config arm64", "layer arm64", "shared layer"} {
+		if _, ok := node.dirs[cid]["blobs/"+computeDigest([]byte(content))]; !ok {
+			t.Errorf("blob %q missing from %s", content, cid)
+		}
+	}
+
+	// a registry without the manifests in its cache pulls them from the image of the index
+	pull := createTestRegistry(api, dir)
+	for _, mf := range manifests {
+		d := computeDigest([]byte(mf))
+		if _, ok := node.dirs[cid]["manifests/"+d]; !ok {
+			t.Errorf("manifest %s missing from %s", d, cid)
+		}
+		rec := request(pull, http.MethodGet, "/v2/app/manifests/"+d, "", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("want %v, got %v: %s", http.StatusOK, rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("X-Docker-Content-ID"); got != cid {
+			t.Errorf("want %v, got %v", cid, got)
+		}
+		if rec.Body.String() != mf {
+			t.Errorf("want %v, got %v", mf, rec.Body)
+		}
+	}
+}
+
+func TestNegotiateManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	api := httptest.NewServer(newImageNode())
+	defer api.Close()
+	r := createTestRegistry(api, dir)
+
+	manifests := map[string]string{}
+	for _, arch := range []string{"amd64", "arm64"} {
+		pushBlob(r, "app", "config "+arch)
+		pushBlob(r, "app", "layer "+arch)
+		mf := imageManifest("config "+arch, "layer "+arch)
+		request(r, http.MethodPut, "/v2/app/manifests/"+computeDigest([]byte(mf)), image.ManifestType, mf)
+		manifests[arch] = mf
+	}
+	index := imageIndex(manifests)
+	if rec := request(r, http.MethodPut, "/v2/app/manifests/v1", image.ManifestListType, index); rec.Code != http.StatusCreated {
+		t.Fatalf("want %v, got %v: %s", http.StatusCreated, rec.Code, rec.Body)
+	}
+
+	for i, tt := range []struct {
+		target string
+		accept string
+		status int
+		body   string
+	}{
+		{"v1", image.ManifestListType, http.StatusOK, index},
+		{"v1", "", http.StatusOK, index},
+		// clients without manifest list support get the image of the default platform
+		{"v1", image.ManifestType, http.StatusOK, manifests["amd64"]},
+		{computeDigest([]byte(index)), image.ManifestListType, http.StatusOK, index},
+		// a digest always refers to the same content
+		{computeDigest([]byte(index)), image.ManifestType, http.StatusNotFound, ""},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v2/app/manifests/"+tt.target, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("want %v, got %v: %s", tt.status, rec.Code, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if rec.Body.String() != tt.body {
+				t.Errorf("want %v, got %v", tt.body, rec.Body)
+			}
+			if digest := rec.Header().Get("Docker-Content-Digest"); digest != computeDigest([]byte(tt.body)) {
+				t.Errorf("want %v, got %v", computeDigest([]byte(tt.body)), digest)
+			}
+		})
+	}
+}
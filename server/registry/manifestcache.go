@@ -0,0 +1,309 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipdr/ipdr/server/registry/image"
+)
+
+// manifestCache is a bounded cache of manifests keyed by digest with a tag to digest index.
+// Entries are evicted least recently used first once the cache exceeds its size,
+// or once they have not been accessed within the TTL.
+//
+// If a location is given the cache survives restarts:
+// <location>/index.json holds the index, <location>/blobs/<digest> the manifests.
+type manifestCache struct {
+	location string
+	maxSize  int64
+	ttl      time.Duration
+
+	// maps repo:tag -> digest
+	tags map[string]*cacheTag
+	// maps digest -> manifest
+	entries map[string]*cacheEntry
+	// maps blob digest -> size, as recorded by the cached manifests
+	blobs map[string]*cacheBlob
+	size  int64
+	lock  sync.Mutex
+}
+
+type cacheTag struct {
+	Digest string    `json:"digest"`
+	Added  time.Time `json:"added"`
+}
+
+type cacheEntry struct {
+	ContentType string           `json:"contentType"`
+	Size        int64            `json:"size"`
+	Accessed    time.Time        `json:"accessed"`
+	Blobs       map[string]int64 `json:"blobs,omitempty"`
+
+	// content is only held in memory if the cache is not backed by disk
+	blob []byte
+}
+
+// cacheBlob is the size of a blob and the number of cached manifests recording it
+type cacheBlob struct {
+	size int64
+	refs int
+}
+
+type cacheIndex struct {
+	Tags    map[string]*cacheTag   `json:"tags"`
+	Entries map[string]*cacheEntry `json:"entries"`
+}
+
+func newManifestCache(location string, maxSize int64, ttl time.Duration) *manifestCache {
+	c := &manifestCache{
+		location: location,
+		maxSize:  maxSize,
+		ttl:      ttl,
+		tags:     map[string]*cacheTag{},
+		entries:  map[string]*cacheEntry{},
+		blobs:    map[string]*cacheBlob{},
+	}
+	c.load()
+	return c
+}
+
+// Get returns the manifest of repo by tag or digest.
+func (c *manifestCache) Get(repo, reference string) (*manifest, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	digest := reference
+	if !strings.HasPrefix(reference, "sha256:") {
+		t, ok := c.tags[key(repo, reference)]
+		if !ok {
+			return nil, false
+		}
+		// tags are mutable, look them up again once expired
+		if c.ttl > 0 && time.Since(t.Added) > c.ttl {
+			delete(c.tags, key(repo, reference))
+			return nil, false
+		}
+		digest = t.Digest
+	}
+
+	e, ok := c.entries[digest]
+	if !ok {
+		return nil, false
+	}
+	if c.ttl > 0 && time.Since(e.Accessed) > c.ttl {
+		c.remove(digest)
+		return nil, false
+	}
+	blob := e.blob
+	if c.location != "" {
+		b, err := ioutil.ReadFile(c.blobPath(digest))
+		if err != nil {
+			c.remove(digest)
+			return nil, false
+		}
+		blob = b
+	}
+	e.Accessed = time.Now()
+
+	return &manifest{
+		blob:        blob,
+		contentType: e.ContentType,
+		digest:      digest,
+	}, true
+}
+
+// Put adds the manifest of repo under its digest and, unless reference is the digest, its tag.
+func (c *manifestCache) Put(repo, reference string, mf *manifest) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.entries[mf.digest]; !ok {
+		e := &cacheEntry{
+			ContentType: mf.contentType,
+			Size:        int64(len(mf.blob)),
+			Blobs:       map[string]int64{},
+		}
+		if f, err := image.DecodeManifest(mf.blob); err == nil {
+			if f.Config != nil {
+				e.Blobs[f.Config.Digest] = f.Config.Size
+			}
+			for _, l := range f.Layers {
+				e.Blobs[l.Digest] = l.Size
+			}
+		}
+		if c.location == "" {
+			e.blob = mf.blob
+		} else if err := c.writeBlob(mf.digest, mf.blob); err != nil {
+			return
+		}
+		c.add(mf.digest, e)
+	}
+	c.entries[mf.digest].Accessed = time.Now()
+
+	if reference != mf.digest {
+		c.tags[key(repo, reference)] = &cacheTag{
+			Digest: mf.digest,
+			Added:  time.Now(),
+		}
+	}
+
+	c.evict()
+	c.save()
+}
+
+// Tags returns the tags of repo that have not expired.
+func (c *manifestCache) Tags(repo string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var tags []string
+	for k, t := range c.tags {
+		tag := strings.TrimPrefix(k, repo+":")
+		if tag == k || strings.Contains(tag, "/") {
+			continue
+		}
+		if c.ttl > 0 && time.Since(t.Added) > c.ttl {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// BlobSize returns the size of a blob as recorded by a cached manifest.
+func (c *manifestCache) BlobSize(digest string) (int64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	b, ok := c.blobs[digest]
+	if !ok {
+		return 0, false
+	}
+	return b.size, true
+}
+
+// evict removes expired entries, then the least recently used ones until the cache fits.
+func (c *manifestCache) evict() {
+	if c.ttl > 0 {
+		for d, e := range c.entries {
+			if time.Since(e.Accessed) > c.ttl {
+				c.remove(d)
+			}
+		}
+	}
+
+	if c.maxSize > 0 && c.size > c.maxSize {
+		digests := make([]string, 0, len(c.entries))
+		for d := range c.entries {
+			digests = append(digests, d)
+		}
+		sort.Slice(digests, func(i, j int) bool {
+			return c.entries[digests[i]].Accessed.Before(c.entries[digests[j]].Accessed)
+		})
+		for _, d := range digests {
+			if c.size <= c.maxSize {
+				break
+			}
+			c.remove(d)
+		}
+	}
+
+	for k, t := range c.tags {
+		if _, ok := c.entries[t.Digest]; !ok {
+			delete(c.tags, k)
+		}
+	}
+}
+
+func (c *manifestCache) add(digest string, e *cacheEntry) {
+	c.entries[digest] = e
+	c.size += e.Size
+	for d, size := range e.Blobs {
+		if b, ok := c.blobs[d]; ok {
+			b.refs++
+			continue
+		}
+		c.blobs[d] = &cacheBlob{size: size, refs: 1}
+	}
+}
+
+func (c *manifestCache) remove(digest string) {
+	e, ok := c.entries[digest]
+	if !ok {
+		return
+	}
+	delete(c.entries, digest)
+	c.size -= e.Size
+	// blobs are shared between manifests, keep the ones another entry still records
+	for d := range e.Blobs {
+		if b := c.blobs[d]; b.refs > 1 {
+			b.refs--
+		} else {
+			delete(c.blobs, d)
+		}
+	}
+	if c.location != "" {
+		os.Remove(c.blobPath(digest))
+	}
+}
+
+func (c *manifestCache) blobPath(digest string) string {
+	return filepath.Join(c.location, "blobs", filepath.Base(digest))
+}
+
+func (c *manifestCache) writeBlob(digest string, b []byte) error {
+	p := c.blobPath(digest)
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, b, 0644)
+}
+
+func (c *manifestCache) load() {
+	if c.location == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(filepath.Join(c.location, "index.json"))
+	if err != nil {
+		return
+	}
+	var idx cacheIndex
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return
+	}
+	for d, e := range idx.Entries {
+		c.add(d, e)
+	}
+	for k, t := range idx.Tags {
+		c.tags[k] = t
+	}
+	c.evict()
+}
+
+// save writes the index, access times are only persisted along with changes.
+func (c *manifestCache) save() error {
+	if c.location == "" {
+		return nil
+	}
+	b, err := json.Marshal(cacheIndex{
+		Tags:    c.tags,
+		Entries: c.entries,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.location, os.ModePerm); err != nil {
+		return err
+	}
+	tmp := filepath.Join(c.location, "index.json.tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(c.location, "index.json"))
+}
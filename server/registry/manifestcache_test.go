@@ -0,0 +1,99 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ipdr/ipdr/server/registry/image"
+)
+
+func TestManifestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := &manifest{blob: []byte(`{"a":1}`), contentType: "a", digest: computeDigest([]byte(`{"a":1}`))}
+	b := &manifest{blob: []byte(`{"b":2}`), contentType: "b", digest: computeDigest([]byte(`{"b":2}`))}
+
+	c := newManifestCache(dir, 10, 0)
+	c.Put("repo", "a", a)
+
+	// survives a restart
+	c = newManifestCache(dir, 10, 0)
+	mf, ok := c.Get("repo", "a")
+	if !ok || string(mf.blob) != string(a.blob) || mf.contentType != "a" {
+		t.Fatalf("want %s, got %v", a.blob, mf)
+	}
+	if _, ok := c.Get("repo", a.digest); !ok {
+		t.Error("expected manifest by digest")
+	}
+
+	// least recently used entry is evicted to make room
+	time.Sleep(time.Millisecond)
+	c.Put("repo", "b", b)
+	if _, ok := c.Get("repo", "a"); ok {
+		t.Error("expected a to be evicted")
+	}
+	if _, ok := c.Get("repo", "b"); !ok {
+		t.Error("expected b to be cached")
+	}
+}
+
+func TestManifestCacheTTL(t *testing.T) {
+	a := &manifest{blob: []byte(`{"a":1}`), contentType: "a", digest: computeDigest([]byte(`{"a":1}`))}
+
+	c := newManifestCache("", 0, time.Millisecond)
+	c.Put("repo", "latest", a)
+	time.Sleep(2 * time.Millisecond)
+	if _, ok := c.Get("repo", "latest"); ok {
+		t.Error("expected tag to expire")
+	}
+	if _, ok := c.Get("repo", a.digest); ok {
+		t.Error("expected manifest to expire")
+	}
+}
+
+func TestManifestCacheBlobSize(t *testing.T) {
+	newManifest := func(config string) *manifest {
+		b := []byte(imageManifest(config, "shared layer"))
+		return &manifest{blob: b, contentType: image.ManifestType, digest: computeDigest(b)}
+	}
+	a, b := newManifest("config a"), newManifest("config b")
+	layer := computeDigest([]byte("shared layer"))
+
+	c := newManifestCache("", 0, 0)
+	c.Put("repo", "a", a)
+	c.Put("repo", "b", b)
+
+	for i, tt := range []struct {
+		remove string
+		digest string
+		size   int64
+		ok     bool
+	}{
+		{"", layer, 12, true},
+		{"", computeDigest([]byte("config a")), 8, true},
+		// the layer is still recorded by b
+		{a.digest, layer, 12, true},
+		{"", computeDigest([]byte("config a")), 0, false},
+		{b.digest, layer, 0, false},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if tt.remove != "" {
+				c.remove(tt.remove)
+			}
+			size, ok := c.BlobSize(tt.digest)
+			if ok != tt.ok {
+				t.Errorf("want %v, got %v", tt.ok, ok)
+			}
+			if size != tt.size {
+				t.Errorf("want %v, got %v", tt.size, size)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ipdr/ipdr/ipfs"
+	"github.com/ipdr/ipdr/regutil"
+)
+
+// ErrNotPinned is the error for unpinning a repo:tag that is not pinned
+var ErrNotPinned = errors.New("not pinned")
+
+// Pin is a CID pinned on the IPFS node and the repo:tag references it is pinned for
+type Pin struct {
+	CID  string
+	Tags []string
+}
+
+// Pinner pins images on the IPFS node by repo:tag, using the CID store to map tags to CIDs.
+// A CID pinned for several tags stays pinned until none of them is pinned. Pins are recursive,
+// so blobs shared with images of other pinned CIDs are kept when an image is unpinned.
+type Pinner struct {
+	cids   *cidStore
+	client *ipfs.Client
+}
+
+// NewPinner returns a pinner for the CID store at the given location
+func NewPinner(client *ipfs.Client, cidStorePath string) *Pinner {
+	return &Pinner{
+		cids:   newCIDStore(cidStorePath),
+		client: client,
+	}
+}
+
+// Pin pins the image of a repo:tag of the CID store, or of a CID, and returns its CID
+func (p *Pinner) Pin(ref string) (string, error) {
+	if cid := toCID(ref); cid != "" {
+		return cid, p.client.Pin(cid)
+	}
+
+	repo, tag := splitReference(ref)
+	cid, ok := p.cids.Get(repo, tag)
+	if !ok {
+		return "", fmt.Errorf("cannot resolve CID: %s:%s", repo, tag)
+	}
+	return cid, p.pin(repo, tag, cid)
+}
+
+// pin pins the cid for repo:reference. The cid previously pinned for repo:reference is unpinned
+// unless other tags are pinned for it.
+func (p *Pinner) pin(repo, reference, cid string) error {
+	pins, err := p.cids.Pins()
+	if err != nil {
+		return err
+	}
+	if err := p.client.Pin(cid); err != nil {
+		return err
+	}
+	if err := p.cids.AddPin(repo, reference, cid); err != nil {
+		return err
+	}
+
+	k := key(repo, reference)
+	old, ok := pins[k]
+	if !ok || regutil.ToB32(old) == regutil.ToB32(cid) || pinnedElsewhere(pins, k, old) {
+		return nil
+	}
+	return p.client.Unpin(old)
+}
+
+// Unpin removes the pin of a repo:tag, or of a CID along with every tag pinned for it.
+// It returns the CID and whether it was unpinned on the IPFS node, which is not the case
+// while other tags are pinned for the CID.
+func (p *Pinner) Unpin(ref string) (string, bool, error) {
+	pins, err := p.cids.Pins()
+	if err != nil {
+		return "", false, err
+	}
+
+	if cid := toCID(ref); cid != "" {
+		for k, c := range pins {
+			if regutil.ToB32(c) == cid {
+				repo, tag := splitReference(k)
+				if err := p.cids.RemovePin(repo, tag); err != nil {
+					return "", false, err
+				}
+			}
+		}
+		return cid, true, p.client.Unpin(cid)
+	}
+
+	repo, tag := splitReference(ref)
+	k := key(repo, tag)
+	cid, ok := pins[k]
+	if !ok {
+		return "", false, ErrNotPinned
+	}
+	if err := p.cids.RemovePin(repo, tag); err != nil {
+		return "", false, err
+	}
+	if pinnedElsewhere(pins, k, cid) {
+		return cid, false, nil
+	}
+	return cid, true, p.client.Unpin(cid)
+}
+
+// pinnedElsewhere returns whether the cid is pinned for another repo:tag than k
+func pinnedElsewhere(pins map[string]string, k, cid string) bool {
+	for other, c := range pins {
+		if other != k && regutil.ToB32(c) == regutil.ToB32(cid) {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the CIDs pinned on the IPFS node with the tags they are pinned for
+func (p *Pinner) List() ([]*Pin, error) {
+	cids, err := p.client.Pins()
+	if err != nil {
+		return nil, err
+	}
+	records, err := p.cids.Pins()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := map[string][]string{}
+	for k, cid := range records {
+		cid = regutil.ToB32(cid)
+		tags[cid] = append(tags[cid], k)
+	}
+
+	list := make([]*Pin, 0, len(cids))
+	for _, cid := range cids {
+		pin := &Pin{CID: cid, Tags: tags[regutil.ToB32(cid)]}
+		sort.Strings(pin.Tags)
+		list = append(list, pin)
+	}
+	return list, nil
+}
+
+// splitReference splits repo[:tag] into the repo and the tag, latest if it has none
+func splitReference(ref string) (string, string) {
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, "latest"
+}
+
+// remotePin pins the cid of repo:reference with the pinning service and logs the outcome.
+// It is meant to run in the background, pinning services may take minutes to fetch an image.
+func (r *registry) remotePin(repo, reference, cid string) {
+	origins, err := r.ipfsClient.Addresses()
+	if err != nil {
+		r.log.Printf("pinning service: addresses of the IPFS node: %v", err)
+	}
+	status, err := r.pinService.PinAndWait(cid, key(repo, reference), origins)
+	if err != nil {
+		if status != nil {
+			r.log.Printf("pinning service: pin of %s:%s (%s) is %s: %v", repo, reference, cid, status.Status, err)
+		} else {
+			r.log.Printf("pinning service: pin of %s:%s (%s): %v", repo, reference, cid, err)
+		}
+		return
+	}
+	r.log.Printf("pinning service: pinned %s:%s (%s)", repo, reference, cid)
+}
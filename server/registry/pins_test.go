@@ -0,0 +1,156 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ipdr/ipdr/ipfs"
+	"github.com/ipdr/ipdr/regutil"
+)
+
+// pinningNode returns a stand-in IPFS node that keeps its pins in pinned
+func pinningNode(pinned map[string]bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cid := req.URL.Query().Get("arg")
+		switch req.URL.Path {
+		case "/api/v0/pin/add":
+			pinned[cid] = true
+		case "/api/v0/pin/rm":
+			delete(pinned, cid)
+		case "/api/v0/pin/ls":
+			keys := map[string]interface{}{}
+			for c := range pinned {
+				keys[c] = map[string]string{"Type": "recursive"}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"Keys": keys})
+			return
+		}
+		fmt.Fprint(w, `{"Pins":[]}`)
+	}))
+}
+
+func TestPinner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the pins of the IPFS node
+	pinned := map[string]bool{}
+	api := pinningNode(pinned)
+	defer api.Close()
+
+	a := regutil.ToB32("QmPZ9gcCEpqKTo6aq61g2nXGUhM4iCL3ewB6LDXZCtioEB")
+	b := regutil.ToB32("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG")
+
+	p := NewPinner(ipfs.NewRemoteClient(&ipfs.Config{Host: strings.TrimPrefix(api.URL, "http://")}), dir)
+	p.cids.Add("app", "v1", a)
+	p.cids.Add("app", "stable", a)
+	p.cids.Add("library/tool", "latest", b)
+
+	for _, ref := range []string{"app:v1", "app:stable", "library/tool"} {
+		if _, err := p.Pin(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := p.Pin("app:missing"); err == nil {
+		t.Error("expected error")
+	}
+
+	list, err := p.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, pin := range list {
+		got = append(got, fmt.Sprintf("%s%v", pin.CID, pin.Tags))
+	}
+	want := []string{a + "[app:stable app:v1]", b + "[library/tool:latest]"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	for i, tt := range []struct {
+		ref      string
+		cid      string
+		unpinned bool
+		err      error
+	}{
+		// another tag is still pinned for the cid
+		{"app:v1", a, false, nil},
+		{"app:v1", "", false, ErrNotPinned},
+		{"app:stable", a, true, nil},
+		{regutil.DockerizeHash("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"), b, true, nil},
+		{"library/tool", "", false, ErrNotPinned},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			cid, unpinned, err := p.Unpin(tt.ref)
+			if err != tt.err {
+				t.Fatalf("want %v, got %v", tt.err, err)
+			}
+			if cid != tt.cid {
+				t.Errorf("want %v, got %v", tt.cid, cid)
+			}
+			if unpinned != tt.unpinned {
+				t.Errorf("want %v, got %v", tt.unpinned, unpinned)
+			}
+		})
+	}
+
+	if len(pinned) != 0 {
+		t.Errorf("want %v, got %v", 0, len(pinned))
+	}
+}
+
+func TestPinnerRepush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pinned := map[string]bool{}
+	api := pinningNode(pinned)
+	defer api.Close()
+
+	a := regutil.ToB32("QmPZ9gcCEpqKTo6aq61g2nXGUhM4iCL3ewB6LDXZCtioEB")
+	b := regutil.ToB32("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG")
+
+	p := NewPinner(ipfs.NewRemoteClient(&ipfs.Config{Host: strings.TrimPrefix(api.URL, "http://")}), dir)
+	for i, tt := range []struct {
+		repo      string
+		reference string
+		cid       string
+		pinned    []string
+	}{
+		{"app", "v1", a, []string{a}},
+		{"app", "v1", a, []string{a}},
+		{"app", "stable", a, []string{a}},
+		// stable is still pinned for a
+		{"app", "v1", b, []string{a, b}},
+		{"app", "stable", b, []string{b}},
+		{"app", "stable", a, []string{a, b}},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if err := p.pin(tt.repo, tt.reference, tt.cid); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for cid := range pinned {
+				got = append(got, cid)
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.pinned) {
+				t.Errorf("want %v, got %v", tt.pinned, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ipdr/ipdr/ipfs"
+)
+
+// PublishedTag is a repo:tag published under an IPNS name
+type PublishedTag struct {
+	Repo      string
+	Reference string
+	CID       string
+	// Root is the CID of the directory of repo/tag -> cid entries the name points to
+	Root string
+	// Name is the IPNS name the directory is published under
+	Name string
+}
+
+// TagPublisher publishes tags in an IPFS directory of repo/tag -> cid entries, the layout read by
+// the IPFS and IPNS resolvers, and republishes the directory under an IPNS key of the IPFS node.
+// Servers with the /ipns/<name> resolver then follow the published tags without DNS changes.
+type TagPublisher struct {
+	client *ipfs.Client
+	cids   *cidStore
+	key    string
+}
+
+// NewTagPublisher returns a publisher of tags under the IPNS key, e.g. self. Tags are mapped to
+// CIDs with the CID store at the given location unless the CID is given.
+func NewTagPublisher(client *ipfs.Client, cidStorePath, key string) *TagPublisher {
+	return &TagPublisher{
+		client: client,
+		cids:   newCIDStore(cidStorePath),
+		key:    key,
+	}
+}
+
+// Publish adds repo:tag -> cid to the directory published under the key and republishes it.
+// The cid of repo:tag is looked up in the CID store if it is empty.
+func (p *TagPublisher) Publish(ref, cid string) (*PublishedTag, error) {
+	repo, tag := splitReference(ref)
+	if cid == "" {
+		var ok bool
+		if cid, ok = p.cids.Get(repo, tag); !ok {
+			return nil, fmt.Errorf("cannot resolve CID: %s:%s", repo, tag)
+		}
+	}
+	c := toCID(cid)
+	if c == "" {
+		return nil, fmt.Errorf("invalid CID: %s", cid)
+	}
+	cid = c
+
+	id, err := p.client.KeyID(p.key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p.key, err)
+	}
+
+	// the directory published so far, a new one if the name has never been published
+	old, err := p.client.ResolveName("/ipns/" + id)
+	if err != nil && err != ipfs.ErrNameNotFound {
+		return nil, err
+	}
+	old = strings.TrimPrefix(old, "/ipfs/")
+	root := old
+	if root == "" {
+		if root, err = p.client.NewDir(); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := p.client.AddBytes([]byte(cid))
+	if err != nil {
+		return nil, err
+	}
+	if root, err = p.client.AddLink(root, repo+"/"+tag, file); err != nil {
+		return nil, err
+	}
+
+	// keep the directory the name points to, the tagged images are pinned on their own
+	if err := p.client.Pin(root); err != nil {
+		return nil, err
+	}
+	name, err := p.client.Publish(p.key, "/ipfs/"+root)
+	if err != nil {
+		return nil, err
+	}
+	if old != "" && old != root {
+		p.client.Unpin(old)
+	}
+
+	return &PublishedTag{
+		Repo:      repo,
+		Reference: tag,
+		CID:       cid,
+		Root:      root,
+		Name:      name,
+	}, nil
+}
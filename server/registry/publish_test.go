@@ -0,0 +1,195 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ipdr/ipdr/ipfs"
+	"github.com/ipdr/ipdr/regutil"
+)
+
+// ipnsNode is a stand-in IPFS node that keeps directories as path -> file CID maps
+type ipnsNode struct {
+	dirs      map[string]map[string]string
+	files     map[string]string
+	published map[string]string
+	pinned    map[string]bool
+	// resolveErr fails name/resolve with the message if set
+	resolveErr string
+}
+
+// apiError answers with an error of the IPFS API
+func apiError(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]interface{}{"Message": msg, "Code": 0, "Type": "error"})
+}
+
+func (n *ipnsNode) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	args := req.URL.Query()["arg"]
+	enc := json.NewEncoder(w)
+	switch strings.TrimPrefix(req.URL.Path, "/api/v0/") {
+	case "key/list":
+		enc.Encode(map[string]interface{}{"Keys": []map[string]string{{"Name": "self", "Id": "k51self"}}})
+	case "name/resolve":
+		if n.resolveErr != "" {
+			apiError(w, n.resolveErr)
+			return
+		}
+		// nodes add context to the error of names without a record
+		root, ok := n.published[strings.TrimPrefix(args[0], "/ipns/")]
+		if !ok {
+			apiError(w, "could not resolve name: "+args[0]+": routing: not found")
+			return
+		}
+		enc.Encode(map[string]string{"Path": "/ipfs/" + root})
+	case "name/publish":
+		n.published["k51self"] = strings.TrimPrefix(args[0], "/ipfs/")
+		enc.Encode(map[string]string{"Name": "k51self", "Value": args[0]})
+	case "object/new":
+		n.dirs["dir"] = map[string]string{}
+		enc.Encode(map[string]string{"Hash": "dir"})
+	case "object/patch/add-link":
+		dir := map[string]string{}
+		for k, v := range n.dirs[args[0]] {
+			dir[k] = v
+		}
+		dir[args[1]] = args[2]
+		hash := fmt.Sprintf("dir%d", len(n.dirs))
+		n.dirs[hash] = dir
+		enc.Encode(map[string]string{"Hash": hash})
+	case "add":
+		for _, b := range multipartFiles(req) {
+			hash := fmt.Sprintf("file%d", len(n.files))
+			n.files[hash] = string(b)
+			enc.Encode(map[string]string{"Hash": hash})
+		}
+	case "pin/add":
+		n.pinned[args[0]] = true
+		enc.Encode(map[string][]string{"Pins": args})
+	case "pin/rm":
+		delete(n.pinned, args[0])
+		enc.Encode(map[string][]string{"Pins": args})
+	case "cat", "ls":
+		ss := strings.SplitN(strings.TrimPrefix(args[0], "/ipns/"), "/", 2)
+		dir := n.dirs[n.published[ss[0]]]
+		if req.URL.Path == "/api/v0/cat" {
+			if file, ok := dir[ss[1]]; ok {
+				fmt.Fprint(w, n.files[file])
+				return
+			}
+			apiError(w, "no link named")
+			return
+		}
+		var links []map[string]string
+		for path := range dir {
+			if strings.HasPrefix(path, ss[1]+"/") {
+				links = append(links, map[string]string{"Name": strings.TrimPrefix(path, ss[1]+"/")})
+			}
+		}
+		enc.Encode(map[string]interface{}{"Objects": []map[string]interface{}{{"Hash": "", "Links": links}}})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestTagPublisher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := &ipnsNode{
+		dirs:      map[string]map[string]string{},
+		files:     map[string]string{},
+		published: map[string]string{},
+		pinned:    map[string]bool{},
+	}
+	api := httptest.NewServer(node)
+	defer api.Close()
+	client := ipfs.NewRemoteClient(&ipfs.Config{Host: strings.TrimPrefix(api.URL, "http://")})
+
+	a := regutil.ToB32("QmPZ9gcCEpqKTo6aq61g2nXGUhM4iCL3ewB6LDXZCtioEB")
+	b := regutil.ToB32("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG")
+
+	p := NewTagPublisher(client, dir, "self")
+	p.cids.Add("app", "v1", a)
+
+	for i, tt := range []struct {
+		ref  string
+		cid  string
+		want string
+	}{
+		{"app:v1", "", a},
+		{"app:v2", "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG", b},
+		{"library/tool", b, b},
+		{"app:v1", b, b},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			published, err := p.Publish(tt.ref, tt.cid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if published.CID != tt.want {
+				t.Errorf("want %v, got %v", tt.want, published.CID)
+			}
+			if published.Name != "k51self" {
+				t.Errorf("want %v, got %v", "k51self", published.Name)
+			}
+			// only the directory published last stays pinned
+			if len(node.pinned) != 1 || !node.pinned[published.Root] {
+				t.Errorf("want %v, got %v", published.Root, node.pinned)
+			}
+		})
+	}
+
+	if _, err := p.Publish("app:missing", ""); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := NewTagPublisher(client, dir, "missing").Publish("app:v1", ""); err == nil {
+		t.Error("expected error")
+	}
+
+	// names that fail to resolve for other reasons than having no record are not published anew
+	root := node.published["k51self"]
+	node.resolveErr = "context deadline exceeded"
+	if _, err := p.Publish("app:v3", b); err == nil {
+		t.Error("expected error")
+	}
+	node.resolveErr = ""
+	if node.published["k51self"] != root {
+		t.Errorf("want %v, got %v", root, node.published["k51self"])
+	}
+
+	r, err := NewIPNSResolver(client, "/ipns/k51self/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tt := range []struct {
+		repo      string
+		reference string
+		want      []string
+	}{
+		{"app", "v1", []string{b}},
+		{"app", "v2", []string{b}},
+		{"library/tool", "latest", []string{b}},
+		{"app", "v3", nil},
+		{"app", "", []string{"v1", "v2"}},
+	} {
+		t.Run(fmt.Sprintf("resolve %v", i), func(t *testing.T) {
+			got := r.Resolve(tt.repo, tt.reference)
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
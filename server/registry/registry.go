@@ -28,10 +28,13 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ipdr/ipdr/ipfs"
+	"github.com/ipdr/ipdr/pinning"
 	"github.com/ipdr/ipdr/regutil"
 )
 
@@ -45,7 +48,44 @@ type Config struct {
 	IPFSHost     string
 	IPFSGateway  string
 	CIDResolvers []string
+	// CIDStorePath is the directory the repo:tag -> cid entries are persisted in.
+	// Entries are kept in memory only if it is empty.
 	CIDStorePath string
+	StagingPath  string
+	// UploadTTL removes blob uploads not written to within the duration, 0 keeps them.
+	UploadTTL time.Duration
+
+	// IPFSGateways are additional gateways to fail over to.
+	IPFSGateways []string
+	// RaceGateways requests content from all gateways at once and takes the first response.
+	RaceGateways bool
+
+	// ManifestCacheSize bounds the manifest cache in bytes, 0 means unbounded.
+	ManifestCacheSize int64
+	// ManifestCacheTTL evicts manifests not accessed within the duration, 0 disables it.
+	ManifestCacheTTL time.Duration
+
+	// BlobCachePath enables a local cache of blobs pulled from IPFS.
+	BlobCachePath string
+	// BlobCacheSize bounds the blob cache in bytes, 0 means unbounded.
+	BlobCacheSize int64
+
+	// ContentFetcher selects how content is read from IPFS: FetchGateway (default), FetchAPI or FetchFallback.
+	ContentFetcher string
+
+	// NoPin skips pinning pushed images, which garbage collection on the IPFS node may then remove.
+	NoPin bool
+	// PinService is the endpoint of an IPFS Pinning Service API to also pin pushed images with.
+	PinService string
+	// PinToken is the access token of the pinning service.
+	PinToken string
+	// PinTimeout bounds waiting for the pinning service to pin an image.
+	PinTimeout time.Duration
+
+	// IndexPath enables the registry index, an MFS directory of repo/tag -> cid files updated on every push.
+	IndexPath string
+	// IndexKey republishes the registry index under the IPNS key after every push.
+	IndexKey string
 }
 
 type registry struct {
@@ -54,9 +94,14 @@ type registry struct {
 	manifests manifests
 
 	cids *cidStore
+	pins *Pinner
+
+	pinService *pinning.Client
+	index      *registryIndex
 
 	config     *Config
 	ipfsClient *ipfs.Client
+	fetcher    fetcher
 
 	resolver CIDResolver
 }
@@ -70,6 +115,9 @@ func (r *registry) v2(resp http.ResponseWriter, req *http.Request) *regError {
 	if isManifest(req) {
 		return r.manifests.handle(resp, req)
 	}
+	if isTags(req) {
+		return r.tags(resp, req)
+	}
 	resp.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
 	if req.URL.Path != "/v2/" && req.URL.Path != "/v2" {
 		return &regError{
@@ -129,7 +177,7 @@ func (r *registry) dig(resp http.ResponseWriter, req *http.Request) {
 		if short {
 			fmt.Fprintln(resp, cid)
 		} else {
-			mf, err := r.manifests.getManifest(cid, tag)
+			mf, err := r.manifests.get(name, tag)
 			if err == nil {
 				fmt.Fprintln(resp, string(mf.blob))
 			}
@@ -156,11 +204,6 @@ func (r *registry) root(resp http.ResponseWriter, req *http.Request) {
 	r.log.Printf("%s %s", req.Method, req.URL)
 }
 
-// ipfsURL returns the full IPFS url
-func (r *registry) ipfsURL(s []string) string {
-	return regutil.IpfsURL(r.config.IPFSGateway, s)
-}
-
 // resolveCID returns content ID
 // Lookup cid by repo:reference (tag/digest) via external services
 // e.g. dnslink/ipns
@@ -183,11 +226,13 @@ func (r *registry) resolve(repo, reference string) []string {
 		return []string{cid}
 	}
 	// repo is a valid cid, ignore reference and assume "latest"
-	if cid := regutil.ToB32(repo); cid != "" {
-		return []string{cid}
+	if root := contentRoot(repo); root != "" {
+		return []string{root}
 	}
-	if hash := regutil.IpfsifyHash(repo); hash != "" {
-		if cid := regutil.ToB32(hash); cid != "" {
+
+	// content addressed, look for any image containing the digest
+	if strings.HasPrefix(reference, "sha256:") {
+		if cid, ok := r.cids.Lookup(reference); ok {
 			return []string{cid}
 		}
 	}
@@ -196,27 +241,74 @@ func (r *registry) resolve(repo, reference string) []string {
 	return r.resolver.Resolve(repo, reference)
 }
 
+// contentRoot returns the IPFS path of the image of a repo that is a cid, or a cid followed by
+// the repository path of an image in a root of several images, e.g. <cid>/library/app,
+// or empty if repo is neither
+func contentRoot(repo string) string {
+	if cid := toCID(repo); cid != "" {
+		return cid
+	}
+	if i := strings.Index(repo, "/"); i > 0 {
+		if cid := toCID(repo[:i]); cid != "" {
+			return cid + repo[i:]
+		}
+	}
+	return ""
+}
+
+// toCID returns the base32 CID of a CID or dockerized hash, or empty if s is neither
+func toCID(s string) string {
+	if cid := regutil.ToB32(s); cid != "" {
+		return cid
+	}
+	if hash := regutil.IpfsifyHash(s); hash != "" {
+		return regutil.ToB32(hash)
+	}
+	return ""
+}
+
 // New returns a handler which implements the docker registry protocol.
 // It should be registered at the site root.
 func New(config *Config, opts ...Option) http.Handler {
 	ipfsClient := ipfs.NewRemoteClient(&ipfs.Config{
-		Host:       config.IPFSHost,
-		GatewayURL: config.IPFSGateway,
+		Host:         config.IPFSHost,
+		GatewayURL:   config.IPFSGateway,
+		GatewayURLs:  config.IPFSGateways,
+		RaceGateways: config.RaceGateways,
 	})
+	stagingPath := config.StagingPath
+	if stagingPath == "" {
+		stagingPath = filepath.Join(os.TempDir(), "ipdr")
+	}
+	var manifestCachePath string
+	if config.CIDStorePath != "" {
+		manifestCachePath = filepath.Join(config.CIDStorePath, ".manifests")
+	}
+	var blobCache *blobCache
+	if config.BlobCachePath != "" {
+		blobCache = newBlobCache(config.BlobCachePath, config.BlobCacheSize)
+	}
 	r := &registry{
 		log: log.New(os.Stderr, "", log.LstdFlags),
 		blobs: blobs{
-			contents: map[string][]byte{},
-			uploads:  map[string][]byte{},
-			layers:   map[string][]string{},
+			staging: newStagingStore(stagingPath, config.UploadTTL),
+			cache:   blobCache,
 		},
 		manifests: manifests{
-			manifests: map[string]map[string]*manifest{},
+			cache: newManifestCache(manifestCachePath, config.ManifestCacheSize, config.ManifestCacheTTL),
 		},
 		cids:       newCIDStore(config.CIDStorePath),
 		ipfsClient: ipfsClient,
 		config:     config,
 	}
+	r.pins = &Pinner{cids: r.cids, client: ipfsClient}
+	if config.PinService != "" {
+		r.pinService = pinning.NewClient(&pinning.Config{
+			Endpoint: config.PinService,
+			Token:    config.PinToken,
+			Timeout:  config.PinTimeout,
+		})
+	}
 	// TODO refactor so we donot have to do this?
 	r.blobs.registry = r
 	r.manifests.registry = r
@@ -226,6 +318,17 @@ func New(config *Config, opts ...Option) http.Handler {
 	for _, o := range opts {
 		o(r)
 	}
+
+	if config.IndexPath != "" {
+		r.index = newRegistryIndex(ipfsClient, config.IndexPath, config.IndexKey, r.log)
+	}
+
+	f, err := newFetcher(config.ContentFetcher, ipfsClient)
+	if err != nil {
+		r.log.Printf("%v, falling back to the gateway", err)
+		f = &gatewayFetcher{gateways: ipfsClient.Gateways()}
+	}
+	r.fetcher = f
 	return http.HandlerFunc(r.root)
 }
 
@@ -94,6 +94,11 @@ func NewDNSLinkResolver(client *ipfs.Client, domain string) (CIDResolver, error)
 		if err != nil {
 			return nil, err
 		}
+	case strings.HasPrefix(txt, "/ipns/"):
+		r, err = NewIPNSResolver(client, txt)
+		if err != nil {
+			return nil, err
+		}
 	default:
 		return nil, fmt.Errorf("not supported: %s", txt)
 	}
@@ -110,19 +115,34 @@ func (r *dnslinkResolver) Resolve(repo, reference string) []string {
 // IPFS resolver
 type ipfsResolver struct {
 	client *ipfs.Client
-	cid    string
+	root   string
 }
 
 func NewIPFSResolver(client *ipfs.Client, root string) (CIDResolver, error) {
 	return &ipfsResolver{
 		client: client,
-		cid:    strings.TrimRight(strings.TrimPrefix(root, "/ipfs/"), "/"), // /ipfs/<cid>
+		root:   strings.TrimRight(strings.TrimPrefix(root, "/ipfs/"), "/"), // /ipfs/<cid>
+	}, nil
+}
+
+// IPNS resolver
+// https://docs.ipfs.io/concepts/ipns/
+// The name is resolved by the IPFS node on every lookup, so it follows the directory
+// published under the name, e.g. with TagPublisher.
+func NewIPNSResolver(client *ipfs.Client, name string) (CIDResolver, error) {
+	name = strings.Trim(strings.TrimPrefix(name, "/ipns/"), "/")
+	if name == "" {
+		return nil, fmt.Errorf("invalid IPNS name")
+	}
+	return &ipfsResolver{
+		client: client,
+		root:   "/ipns/" + name, // /ipns/<name>
 	}, nil
 }
 
 func (r *ipfsResolver) Resolve(repo string, reference string) []string {
 	if reference == "" {
-		links, err := r.client.List(fmt.Sprintf("%s/%s", r.cid, repo))
+		links, err := r.client.List(fmt.Sprintf("%s/%s", r.root, repo))
 		if err != nil {
 			return nil
 		}
@@ -140,7 +160,7 @@ func (r *ipfsResolver) Resolve(repo string, reference string) []string {
 }
 
 func (r *ipfsResolver) getContent(repo, reference string) ([]byte, error) {
-	rd, err := r.client.Cat(fmt.Sprintf("%s/%s/%s", r.cid, repo, reference))
+	rd, err := r.client.Cat(fmt.Sprintf("%s/%s/%s", r.root, repo, reference))
 	if err != nil {
 		return nil, err
 	}
@@ -164,6 +184,10 @@ func NewResolver(client *ipfs.Client, list []string) CIDResolver {
 			if r, err := NewIPFSResolver(client, l); err == nil {
 				resolvers = append(resolvers, r)
 			}
+		case strings.HasPrefix(l, "/ipns/"):
+			if r, err := NewIPNSResolver(client, l); err == nil {
+				resolvers = append(resolvers, r)
+			}
 		default:
 			// assume dnslink
 			if r, err := NewDNSLinkResolver(client, l); err == nil {
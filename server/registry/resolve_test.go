@@ -0,0 +1,54 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/ipdr/ipdr/regutil"
+)
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &registry{
+		log: log.New(ioutil.Discard, "", 0),
+		cids: &cidStore{
+			cids:     map[string]string{},
+			digests:  map[string]string{},
+			location: dir,
+		},
+		resolver: NewResolver(nil, nil),
+	}
+
+	hash := "QmPZ9gcCEpqKTo6aq61g2nXGUhM4iCL3ewB6LDXZCtioEB"
+	cid := regutil.ToB32(hash)
+
+	for i, tt := range []struct {
+		repo string
+		want string
+	}{
+		{hash, cid},
+		{cid, cid},
+		{regutil.DockerizeHash(hash), cid},
+		{cid + "/library/app", cid + "/library/app"},
+		{regutil.DockerizeHash(hash) + "/org/tool", cid + "/org/tool"},
+		{"library/app", ""},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			var got string
+			if list := r.resolve(tt.repo, "v1"); len(list) > 0 {
+				got = list[0]
+			}
+			if got != tt.want {
+				t.Errorf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
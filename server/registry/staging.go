@@ -0,0 +1,209 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	errDigestMismatch = errors.New("digest does not match contents")
+	errUploadUnknown  = errors.New("upload is completed, cancelled or expired")
+)
+
+// stagingStore keeps pushed blobs on disk until they are added to IPFS.
+// Uploads not written to within the TTL are removed.
+//
+// <location>/uploads/<id> holds uploads in progress,
+// <location>/blobs/<digest> holds completed blobs.
+type stagingStore struct {
+	location string
+	ttl      time.Duration
+
+	// maps upload id -> upload in progress
+	uploads map[string]*upload
+	lock    sync.Mutex
+}
+
+// upload is an upload in progress, its lock serializes the writes of concurrent requests.
+type upload struct {
+	// running digest of the upload
+	hash hash.Hash
+	// closed is set once the upload is committed, cancelled or expired
+	closed bool
+	lock   sync.Mutex
+}
+
+func newStagingStore(location string, ttl time.Duration) *stagingStore {
+	s := &stagingStore{
+		location: location,
+		ttl:      ttl,
+		uploads:  map[string]*upload{},
+	}
+	if ttl > 0 {
+		s.expire()
+		go func() {
+			for range time.Tick(ttl) {
+				s.expire()
+			}
+		}()
+	}
+	return s
+}
+
+func (s *stagingStore) uploadPath(id string) string {
+	return filepath.Join(s.location, "uploads", filepath.Base(id))
+}
+
+// BlobPath returns the location of a completed blob.
+func (s *stagingStore) BlobPath(digest string) string {
+	return filepath.Join(s.location, "blobs", filepath.Base(digest))
+}
+
+// UploadSize returns the number of bytes received so far for an upload.
+func (s *stagingStore) UploadSize(id string) (int64, bool) {
+	fi, err := os.Stat(s.uploadPath(id))
+	if err != nil {
+		return 0, false
+	}
+	return fi.Size(), true
+}
+
+// Append streams r to the end of the upload and returns the new upload size.
+func (s *stagingStore) Append(id string, r io.Reader) (int64, error) {
+	p := s.uploadPath(id)
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return 0, err
+	}
+	u, err := s.upload(id)
+	if err != nil {
+		return 0, err
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.closed {
+		return 0, errUploadUnknown
+	}
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(io.MultiWriter(f, u.hash), r); err != nil {
+		return 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Commit completes the upload and moves it to the blobs if its content matches digest.
+func (s *stagingStore) Commit(id, digest string) error {
+	u, err := s.upload(id)
+	if err != nil {
+		return err
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.closed {
+		return errUploadUnknown
+	}
+	if "sha256:"+hex.EncodeToString(u.hash.Sum(nil)) != digest {
+		return errDigestMismatch
+	}
+
+	p := s.BlobPath(digest)
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(s.uploadPath(id), p); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	delete(s.uploads, id)
+	s.lock.Unlock()
+	u.closed = true
+	return nil
+}
+
+// Cancel discards an upload, once writes in progress are done.
+func (s *stagingStore) Cancel(id string) {
+	s.lock.Lock()
+	u, ok := s.uploads[id]
+	delete(s.uploads, id)
+	s.lock.Unlock()
+
+	if ok {
+		u.lock.Lock()
+		defer u.lock.Unlock()
+		u.closed = true
+	}
+	os.Remove(s.uploadPath(id))
+}
+
+// expire cancels the uploads not written to within the TTL.
+func (s *stagingStore) expire() {
+	entries, err := ioutil.ReadDir(filepath.Join(s.location, "uploads"))
+	if err != nil {
+		return
+	}
+	for _, fi := range entries {
+		if time.Since(fi.ModTime()) > s.ttl {
+			s.Cancel(fi.Name())
+		}
+	}
+}
+
+// Stat returns the size of a completed blob.
+func (s *stagingStore) Stat(digest string) (int64, bool) {
+	fi, err := os.Stat(s.BlobPath(digest))
+	if err != nil {
+		return 0, false
+	}
+	return fi.Size(), true
+}
+
+// Remove deletes a completed blob.
+func (s *stagingStore) Remove(digest string) {
+	os.Remove(s.BlobPath(digest))
+}
+
+// upload returns the upload in progress. Its running digest is rebuilt
+// from the partial upload on disk if it is not known, e.g. after a restart.
+func (s *stagingStore) upload(id string) (*upload, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if u, ok := s.uploads[id]; ok {
+		return u, nil
+	}
+
+	h := sha256.New()
+	f, err := os.Open(s.uploadPath(id))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		_, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	u := &upload{hash: h}
+	s.uploads[id] = u
+	return u, nil
+}
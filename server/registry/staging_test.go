@@ -0,0 +1,116 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStagingStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// sha256 of "hello world"
+	digest := "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+	s := newStagingStore(dir, 0)
+	if _, err := s.Append("1", strings.NewReader("hello ")); err != nil {
+		t.Fatal(err)
+	}
+
+	// resume the upload as if the server had been restarted
+	s = newStagingStore(dir, 0)
+	size, err := s.Append("1", strings.NewReader("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 11 {
+		t.Errorf("want %v, got %v", 11, size)
+	}
+	if err := s.Commit("1", "sha256:0000"); err != errDigestMismatch {
+		t.Errorf("want %v, got %v", errDigestMismatch, err)
+	}
+	if err := s.Commit("1", digest); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.UploadSize("1"); ok {
+		t.Error("expected upload to be removed")
+	}
+	if size, ok := s.Stat(digest); !ok || size != 11 {
+		t.Errorf("want blob of size %v, got %v", 11, size)
+	}
+}
+
+func TestStagingStoreConcurrentAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newStagingStore(dir, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Append("1", strings.NewReader("chunk")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// every chunk is hashed in the order it is written
+	if err := s.Commit("1", computeDigest([]byte(strings.Repeat("chunk", 10)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Append("1", strings.NewReader("chunk")); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := s.UploadSize("1"); size != 5 {
+		t.Errorf("want %v, got %v", 5, size)
+	}
+}
+
+func TestStagingStoreExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newStagingStore(dir, 0)
+	for _, id := range []string{"old", "new"} {
+		if _, err := s.Append(id, strings.NewReader(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(s.uploadPath("old"), past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	// expired uploads are removed when the store starts
+	s = newStagingStore(dir, time.Hour)
+	for i, tt := range []struct {
+		id string
+		ok bool
+	}{
+		{"old", false},
+		{"new", true},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if _, ok := s.UploadSize(tt.id); ok != tt.ok {
+				t.Errorf("want %v, got %v", tt.ok, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func isTags(req *http.Request) bool {
+	elems := strings.Split(req.URL.Path, "/")
+	elems = elems[1:]
+	if len(elems) < 4 {
+		return false
+	}
+	return elems[0] == "v2" && elems[len(elems)-2] == "tags" && elems[len(elems)-1] == "list"
+}
+
+// https://github.com/opencontainers/distribution-spec/blob/master/spec.md#listing-tags
+// https://docs.docker.com/registry/spec/api/#listing-image-tags
+func (r *registry) tags(resp http.ResponseWriter, req *http.Request) *regError {
+	if req.Method != http.MethodGet {
+		return &regError{
+			Status:  http.StatusBadRequest,
+			Code:    "METHOD_UNKNOWN",
+			Message: "We don't understand your method + url",
+		}
+	}
+
+	elem := strings.Split(req.URL.Path, "/")
+	elem = elem[1:]
+	repo := strings.Join(elem[1:len(elem)-2], "/")
+
+	query := req.URL.Query()
+	n := -1
+	if s := query.Get("n"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 0 {
+			return &regError{
+				Status:  http.StatusBadRequest,
+				Code:    "PAGINATION_NUMBER_INVALID",
+				Message: fmt.Sprintf("invalid number of results requested: %s", s),
+			}
+		}
+		n = v
+	}
+
+	tags := r.listTags(repo)
+	if len(tags) == 0 {
+		return &regError{
+			Status:  http.StatusNotFound,
+			Code:    "NAME_UNKNOWN",
+			Message: fmt.Sprintf("Unknown name %q", repo),
+		}
+	}
+
+	// tags are in lexical order, the page starts after the last tag of the previous page
+	if last := query.Get("last"); last != "" {
+		tags = tags[sort.SearchStrings(tags, last):]
+		if len(tags) > 0 && tags[0] == last {
+			tags = tags[1:]
+		}
+	}
+	if n >= 0 && len(tags) > n {
+		tags = tags[:n]
+		if n > 0 {
+			next := url.Values{}
+			next.Set("n", strconv.Itoa(n))
+			next.Set("last", tags[n-1])
+			resp.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", req.URL.Path, next.Encode()))
+		}
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	json.NewEncoder(resp).Encode(struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{
+		Name: repo,
+		Tags: tags,
+	})
+	return nil
+}
+
+// listTags returns the tags of repo in lexical order. The tags of a cid are the manifests of its
+// image, the tags of other repos those listed by the resolvers and those of cached manifests.
+func (r *registry) listTags(repo string) []string {
+	var list []string
+	if root := contentRoot(repo); root != "" {
+		if links, err := r.ipfsClient.List(root + "/manifests"); err == nil {
+			for _, l := range links {
+				list = append(list, l.Name)
+			}
+		}
+	} else {
+		list = append(list, r.resolver.Resolve(repo, "")...)
+		list = append(list, r.manifests.cache.Tags(repo)...)
+	}
+
+	tags := []string{}
+	for _, t := range uniq(list) {
+		if !strings.HasPrefix(t, "sha256:") {
+			tags = append(tags, t)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
@@ -0,0 +1,102 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipdr/ipdr/ipfs"
+	"github.com/ipdr/ipdr/regutil"
+)
+
+func TestTagsList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// tags of the file resolver
+	for _, tag := range []string{"v1", "v2", "latest"} {
+		if err := os.MkdirAll(filepath.Join(dir, "library/app"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "library/app", tag), []byte("bafy"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hash := "QmPZ9gcCEpqKTo6aq61g2nXGUhM4iCL3ewB6LDXZCtioEB"
+	cid := regutil.ToB32(hash)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v0/ls" || req.URL.Query().Get("arg") != cid+"/manifests" {
+			http.NotFound(w, req)
+			return
+		}
+		var links []map[string]string
+		for _, name := range []string{"latest", "v3", "sha256:" + strings.Repeat("0", 64)} {
+			links = append(links, map[string]string{"Name": name})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Objects": []map[string]interface{}{{"Hash": cid, "Links": links}}})
+	}))
+	defer api.Close()
+
+	r := &registry{
+		log:        log.New(ioutil.Discard, "", 0),
+		resolver:   NewResolver(nil, []string{"file:" + dir}),
+		ipfsClient: ipfs.NewRemoteClient(&ipfs.Config{Host: strings.TrimPrefix(api.URL, "http://")}),
+		manifests: manifests{
+			cache: newManifestCache("", 0, 0),
+		},
+	}
+	r.manifests.cache.Put("library/app", "beta", &manifest{blob: []byte("{}"), digest: "sha256:beta"})
+	r.manifests.cache.Put("library/app", "sha256:beta", &manifest{blob: []byte("{}"), digest: "sha256:beta"})
+	r.manifests.cache.Put("library/app/sub", "v9", &manifest{blob: []byte("{}"), digest: "sha256:sub"})
+
+	for i, tt := range []struct {
+		path   string
+		status int
+		tags   []string
+		link   string
+	}{
+		{"/v2/library/app/tags/list", http.StatusOK, []string{"beta", "latest", "v1", "v2"}, ""},
+		{"/v2/library/app/tags/list?n=2", http.StatusOK, []string{"beta", "latest"}, `</v2/library/app/tags/list?last=latest&n=2>; rel="next"`},
+		{"/v2/library/app/tags/list?n=2&last=latest", http.StatusOK, []string{"v1", "v2"}, ""},
+		{"/v2/library/app/tags/list?last=c", http.StatusOK, []string{"latest", "v1", "v2"}, ""},
+		{"/v2/library/app/tags/list?n=0", http.StatusOK, []string{}, ""},
+		{"/v2/library/app/tags/list?n=-1", http.StatusBadRequest, nil, ""},
+		{"/v2/" + regutil.DockerizeHash(hash) + "/tags/list", http.StatusOK, []string{"latest", "v3"}, ""},
+		{"/v2/library/unknown/tags/list", http.StatusNotFound, nil, ""},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			r.root(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.status {
+				t.Fatalf("want %v, got %v", tt.status, rec.Code)
+			}
+			if link := rec.Header().Get("Link"); link != tt.link {
+				t.Errorf("want %v, got %v", tt.link, link)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var body struct {
+				Name string
+				Tags []string
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(body.Tags) != fmt.Sprint(tt.tags) {
+				t.Errorf("want %v, got %v", tt.tags, body.Tags)
+			}
+		})
+	}
+}
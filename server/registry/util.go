@@ -3,21 +3,19 @@ package registry
 import (
 	"fmt"
 	"io/ioutil"
-	"net/http"
-
-	"github.com/ipdr/ipdr/netutil"
-	"github.com/ipdr/ipdr/regutil"
+	"strings"
 )
 
-func getContent(gw string, cid string, s []string) ([]byte, error) {
-	uri := regutil.IpfsURL(gw, append([]string{cid}, s...))
-	resp, err := netutil.Get(uri)
+func getContent(f fetcher, cid string, s []string) ([]byte, error) {
+	rc, err := f.Fetch(ipfsPath(append([]string{cid}, s...)), 0, -1)
 	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("cid: %s %s", cid, resp.Status)
+		return nil, fmt.Errorf("cid: %s %v", cid, err)
 	}
-	return ioutil.ReadAll(resp.Body)
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// ipfsPath returns the IPFS path of the given elements, e.g. /ipfs/<cid>/blobs/<digest>
+func ipfsPath(s []string) string {
+	return "/ipfs/" + strings.Join(s, "/")
 }
@@ -0,0 +1,29 @@
+package registry
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+// multipartFiles returns the files of a multipart request to the IPFS API by name,
+// e.g. of add or files/write. Directory parts are skipped.
+func multipartFiles(req *http.Request) map[string][]byte {
+	files := map[string][]byte{}
+	_, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	mr := multipart.NewReader(req.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return files
+		}
+		if part.Header.Get("Content-Type") == "application/x-directory" {
+			continue
+		}
+		_, disposition, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		name, _ := url.QueryUnescape(disposition["filename"])
+		files[name], _ = ioutil.ReadAll(part)
+	}
+}
@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+)
+
+// digestVerifier passes content through while computing its sha256 digest and fails
+// with errDigestMismatch instead of io.EOF if the content does not match.
+// The last byte is held back until the content is verified, so that a reader never
+// receives the complete content of a mismatching blob.
+type digestVerifier struct {
+	r      io.Reader
+	digest string
+	h      hash.Hash
+
+	held bool
+	last byte
+	eof  bool
+	err  error
+}
+
+// newDigestVerifier returns a reader verifying r against digest. Digests
+// that cannot be verified are passed through unchecked.
+func newDigestVerifier(r io.Reader, digest string) io.Reader {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return r
+	}
+	return &digestVerifier{
+		r:      r,
+		digest: digest,
+		h:      sha256.New(),
+	}
+}
+
+func (v *digestVerifier) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if v.eof {
+		// content verified, release the held back byte
+		v.err = io.EOF
+		if !v.held {
+			return 0, io.EOF
+		}
+		v.held = false
+		p[0] = v.last
+		return 1, io.EOF
+	}
+
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if n > 0 {
+		last := p[n-1]
+		if v.held {
+			copy(p[1:n], p[:n-1])
+			p[0] = v.last
+		} else {
+			n--
+		}
+		v.last, v.held = last, true
+	}
+
+	switch {
+	case err == io.EOF:
+		if "sha256:"+hex.EncodeToString(v.h.Sum(nil)) != v.digest {
+			v.err = errDigestMismatch
+			return n, v.err
+		}
+		v.eof = true
+		return n, nil
+	case err != nil:
+		v.err = err
+		return n, err
+	}
+	return n, nil
+}
@@ -0,0 +1,47 @@
+package registry
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDigestVerifier(t *testing.T) {
+	// sha256 of "hello world"
+	digest := "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+	for i, tt := range []struct {
+		content string
+		digest  string
+		err     error
+	}{
+		{"hello world", digest, nil},
+		{"hello world", "sha256:0000", errDigestMismatch},
+		{"hello", digest, errDigestMismatch},
+		{"", digest, errDigestMismatch},
+		{"anything", "sha512:0000", nil},
+	} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			for _, wrap := range []func(io.Reader) io.Reader{
+				func(r io.Reader) io.Reader { return r },
+				iotest.OneByteReader,
+				iotest.HalfReader,
+			} {
+				b, err := ioutil.ReadAll(wrap(newDigestVerifier(strings.NewReader(tt.content), tt.digest)))
+				if err != tt.err {
+					t.Errorf("want %v, got %v", tt.err, err)
+				}
+				if tt.err == nil && string(b) != tt.content {
+					t.Errorf("want %v, got %s", tt.content, b)
+				}
+				// mismatching content is never passed through completely
+				if tt.err != nil && len(tt.content) > 0 && len(b) >= len(tt.content) {
+					t.Errorf("got complete content %s", b)
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"time"
 
 	ipfs "github.com/ipdr/ipdr/ipfs"
 	"github.com/ipdr/ipdr/server/registry"
@@ -16,11 +17,26 @@ type Server struct {
 	listener     net.Listener
 	host         string
 	ipfsHost     string
-	ipfsGateway  string
+	ipfsGateways []string
+	raceGateways bool
 	cidResolvers []string
 	cidStorePath string
+	stagingPath  string
 	tlsCertPath  string
 	tlsKeyPath   string
+
+	uploadTTL         time.Duration
+	manifestCacheSize int64
+	manifestCacheTTL  time.Duration
+	blobCachePath     string
+	blobCacheSize     int64
+	contentFetcher    string
+	noPin             bool
+	pinService        string
+	pinToken          string
+	pinTimeout        time.Duration
+	indexPath         string
+	indexKey          string
 }
 
 // Config is server config
@@ -29,10 +45,30 @@ type Config struct {
 	Port         uint
 	IPFSHost     string
 	IPFSGateway  string
+	IPFSGateways []string
+	RaceGateways bool
 	CIDResolvers []string
 	CIDStorePath string
+	StagingPath  string
 	TLSCertPath  string
 	TLSKeyPath   string
+
+	UploadTTL         time.Duration
+	ManifestCacheSize int64
+	ManifestCacheTTL  time.Duration
+	BlobCachePath     string
+	BlobCacheSize     int64
+	ContentFetcher    string
+	// NoPin skips pinning pushed images
+	NoPin bool
+	// PinService is the endpoint of an IPFS Pinning Service API to also pin pushed images with
+	PinService string
+	PinToken   string
+	PinTimeout time.Duration
+	// IndexPath enables the registry index, an MFS directory of repo/tag -> cid files updated on every push
+	IndexPath string
+	// IndexKey republishes the registry index under the IPNS key after every push
+	IndexKey string
 }
 
 // InfoResponse is response for manifest info response
@@ -57,15 +93,39 @@ func NewServer(config *Config) *Server {
 		port = config.Port
 	}
 
+	// additional gateways replace the default gateway unless it is set
+	var gateways []string
+	if config.IPFSGateway != "" || len(config.IPFSGateways) == 0 {
+		gateways = append(gateways, ipfs.NormalizeGatewayURL(config.IPFSGateway))
+	}
+	for _, gw := range config.IPFSGateways {
+		gateways = append(gateways, ipfs.NormalizeGatewayURL(gw))
+	}
+
 	return &Server{
 		host:         fmt.Sprintf("0.0.0.0:%v", port),
 		debug:        config.Debug,
 		ipfsHost:     config.IPFSHost,
-		ipfsGateway:  ipfs.NormalizeGatewayURL(config.IPFSGateway),
+		ipfsGateways: gateways,
+		raceGateways: config.RaceGateways,
 		cidResolvers: config.CIDResolvers,
 		cidStorePath: config.CIDStorePath,
+		stagingPath:  config.StagingPath,
 		tlsCertPath:  config.TLSCertPath,
 		tlsKeyPath:   config.TLSKeyPath,
+
+		uploadTTL:         config.UploadTTL,
+		manifestCacheSize: config.ManifestCacheSize,
+		manifestCacheTTL:  config.ManifestCacheTTL,
+		blobCachePath:     config.BlobCachePath,
+		blobCacheSize:     config.BlobCacheSize,
+		contentFetcher:    config.ContentFetcher,
+		noPin:             config.NoPin,
+		pinService:        config.PinService,
+		pinToken:          config.PinToken,
+		pinTimeout:        config.PinTimeout,
+		indexPath:         config.IndexPath,
+		indexKey:          config.IndexKey,
 	}
 }
 
@@ -82,9 +142,24 @@ func (s *Server) Start() error {
 
 	http.Handle("/", registry.New(&registry.Config{
 		IPFSHost:     s.ipfsHost,
-		IPFSGateway:  s.ipfsGateway,
+		IPFSGateways: s.ipfsGateways,
+		RaceGateways: s.raceGateways,
 		CIDResolvers: s.cidResolvers,
 		CIDStorePath: s.cidStorePath,
+		StagingPath:  s.stagingPath,
+
+		UploadTTL:         s.uploadTTL,
+		ManifestCacheSize: s.manifestCacheSize,
+		ManifestCacheTTL:  s.manifestCacheTTL,
+		BlobCachePath:     s.blobCachePath,
+		BlobCacheSize:     s.blobCacheSize,
+		ContentFetcher:    s.contentFetcher,
+		NoPin:             s.noPin,
+		PinService:        s.pinService,
+		PinToken:          s.pinToken,
+		PinTimeout:        s.pinTimeout,
+		IndexPath:         s.indexPath,
+		IndexKey:          s.indexKey,
 	}))
 
 	var err error